@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/ssh"
+)
+
+// how much of the end of an existing audit log is read to continue its chain
+const auditTailSize = 64 * 1024
+
+var metricAuditFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "pubkeyd_audit_failures_total",
+	Help: "Number of audit events that couldn't be written.",
+})
+
+func init() {
+	prometheus.MustRegister(metricAuditFailuresTotal)
+}
+
+// AuditEvent records a key lookup
+type AuditEvent struct {
+	Time     time.Time `json:"time"`
+	ClientIP string    `json:"client_ip"`
+	// name of the API token of the request
+	Token string `json:"token,omitempty"`
+	// name in the client certificate of the host
+	Host string `json:"host,omitempty"`
+	// tenant the user belongs to, empty for the main identity provider
+	Tenant       string   `json:"tenant,omitempty"`
+	User         string   `json:"user"`
+	GithubName   string   `json:"github,omitempty"`
+	Fingerprints []string `json:"fingerprints,omitempty"`
+	// key cache result, see cachedAuthorizedKeys
+	Cache    string `json:"cache,omitempty"`
+	Status   int    `json:"status"`
+	PrevHash string `json:"prev_hash,omitempty"`
+}
+
+// newAuditEvent returns the event of a lookup of user's keys by r
+func newAuditEvent(r *http.Request, user string) *AuditEvent {
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+	event := &AuditEvent{
+		Time:     time.Now().UTC(),
+		ClientIP: clientIP,
+		Token:    tokenName(r),
+		User:     user,
+	}
+	if names := clientNames(r); len(names) > 0 {
+		event.Host = names[0]
+	}
+	return event
+}
+
+// setKeys records the fingerprints of the keys in authorizedKeys
+func (e *AuditEvent) setKeys(authorizedKeys string) {
+	rest := []byte(authorizedKeys)
+	for len(rest) > 0 {
+		key, _, _, next, err := ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			break
+		}
+		rest = next
+		e.Fingerprints = append(e.Fingerprints, ssh.FingerprintSHA256(key))
+	}
+}
+
+// AuditLog writes audit events as JSON lines to a file that is rotated when
+// it grows beyond MaxSize, keeping MaxBackups old files as path.1, path.2,
+// ... With Chain each event carries the hash of the previous event in
+// prev_hash and its own hash in a trailing hash field. The hash is the hex
+// SHA-256 of the line up to the hash field, closed with }, or its
+// HMAC-SHA256 with Key so that the chain can't be recomputed without it.
+type AuditLog struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+	Chain      bool
+	Key        []byte
+
+	mutex    sync.Mutex
+	file     *os.File
+	size     int64
+	lastHash string
+}
+
+// NewAuditLog opens the audit log at path and continues its hash chain
+func NewAuditLog(path string, maxSize int64, maxBackups int, chain bool, key []byte) (*AuditLog, error) {
+	a := &AuditLog{Path: path, MaxSize: maxSize, MaxBackups: maxBackups, Chain: chain, Key: key}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	if chain {
+		lastHash, err := lastAuditHash(path)
+		if err != nil {
+			return nil, err
+		}
+		a.lastHash = lastHash
+	}
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	file, err := os.OpenFile(a.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to open audit log: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Failed to open audit log: %v", err)
+	}
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+func (a *AuditLog) rotate() error {
+	a.file.Close()
+	for i := a.MaxBackups; i > 0; i-- {
+		from := a.Path
+		if i > 1 {
+			from += "." + strconv.Itoa(i-1)
+		}
+		if err := os.Rename(from, a.Path+"."+strconv.Itoa(i)); err != nil && !os.IsNotExist(err) {
+			log.Errorf("Failed to rotate audit log: %v", err)
+		}
+	}
+	if a.MaxBackups == 0 {
+		os.Remove(a.Path)
+	}
+	return a.open()
+}
+
+// record writes event to the audit log
+func (a *AuditLog) record(event *AuditEvent) {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.Chain {
+		event.PrevHash = a.lastHash
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Errorf("Failed to encode audit event: %v", err)
+		metricAuditFailuresTotal.Inc()
+		return
+	}
+	hash := ""
+	if a.Chain {
+		hash = auditHash(a.Key, line)
+		line = append(line[:len(line)-1], []byte(`,"hash":"`+hash+`"}`)...)
+	}
+	line = append(line, '\n')
+
+	if a.MaxSize > 0 && a.size+int64(len(line)) > a.MaxSize && a.size > 0 {
+		if err := a.rotate(); err != nil {
+			log.Error(err)
+			metricAuditFailuresTotal.Inc()
+			return
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		log.Errorf("Failed to write audit event: %v", err)
+		metricAuditFailuresTotal.Inc()
+		return
+	}
+	a.lastHash = hash
+}
+
+// auditHash returns the hex SHA-256 of line, or its HMAC-SHA256 with key
+func auditHash(key []byte, line []byte) string {
+	if key == nil {
+		sum := sha256.Sum256(line)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(line)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// loadAuditKey reads the HMAC key of the audit log chain from path
+func loadAuditKey(path string) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read audit log key: %v", err)
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("Audit log key file %s is empty", path)
+	}
+	return key, nil
+}
+
+// readAuditLines calls f with every line read from reader, lines are not
+// limited in length as events of large shared accounts list many keys
+func readAuditLines(reader io.Reader, f func(line []byte) error) error {
+	buffered := bufio.NewReader(reader)
+	for {
+		line, err := buffered.ReadBytes('\n')
+		if len(line) > 0 {
+			if ferr := f(bytes.TrimSuffix(line, []byte("\n"))); ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// splitAuditHash splits a chained audit log line into the hashed part and
+// the hash
+func splitAuditHash(line []byte) ([]byte, string, bool) {
+	suffix := []byte(`,"hash":"`)
+	i := bytes.LastIndex(line, suffix)
+	if i < 0 || !bytes.HasSuffix(line, []byte(`"}`)) {
+		return nil, "", false
+	}
+	return append(append([]byte{}, line[:i]...), '}'), string(line[i+len(suffix) : len(line)-2]), true
+}
+
+// lastAuditHash returns the hash of the last event in the audit log at path.
+// Only its end is read, a partial first line still ends with its hash.
+func lastAuditHash(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read audit log: %v", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", fmt.Errorf("Failed to read audit log: %v", err)
+	}
+	if info.Size() > auditTailSize {
+		file.Seek(info.Size()-auditTailSize, io.SeekStart)
+	}
+	lastHash := ""
+	err = readAuditLines(file, func(line []byte) error {
+		if _, hash, ok := splitAuditHash(line); ok {
+			lastHash = hash
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("Failed to read audit log: %v", err)
+	}
+	return lastHash, nil
+}
+
+// verifyAuditLog checks the hash chain of the audit log files in order,
+// oldest first, with the HMAC key the log was written with if any and
+// returns the number of verified events
+func verifyAuditLog(paths []string, key []byte) (int, error) {
+	count := 0
+	prevHash := ""
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return count, err
+		}
+		lineNumber := 0
+		err = readAuditLines(file, func(line []byte) error {
+			lineNumber++
+			hashed, hash, ok := splitAuditHash(line)
+			if !ok {
+				return fmt.Errorf("%s:%d: event has no hash", path, lineNumber)
+			}
+			var event AuditEvent
+			if err := json.Unmarshal(hashed, &event); err != nil {
+				return fmt.Errorf("%s:%d: %v", path, lineNumber, err)
+			}
+			if count > 0 && event.PrevHash != prevHash {
+				return fmt.Errorf("%s:%d: chain broken, previous event hash %s, expected %s", path, lineNumber, event.PrevHash, prevHash)
+			}
+			if !hmac.Equal([]byte(auditHash(key, hashed)), []byte(hash)) {
+				return fmt.Errorf("%s:%d: event was modified", path, lineNumber)
+			}
+			prevHash = hash
+			count++
+			return nil
+		})
+		file.Close()
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeAuditEvents records count events, every third one with enough
+// fingerprints to exceed auditTailSize
+func writeAuditEvents(t *testing.T, a *AuditLog, count int) {
+	for i := 0; i < count; i++ {
+		event := &AuditEvent{Time: time.Unix(int64(i), 0).UTC(), ClientIP: "10.0.0.7", User: "deploy", Status: 200}
+		if i%3 == 0 {
+			for j := 0; j < 2000; j++ {
+				event.Fingerprints = append(event.Fingerprints, fmt.Sprintf("SHA256:%043d", j))
+			}
+		}
+		a.record(event)
+	}
+}
+
+func TestAuditLogLongLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pubkeyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	a, err := NewAuditLog(path, 0, 0, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAuditEvents(t, a, 4)
+	a.file.Close()
+	// the restarted log continues the chain after a line longer than the tail
+	if a, err = NewAuditLog(path, 0, 0, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	writeAuditEvents(t, a, 2)
+	a.file.Close()
+
+	if count, err := verifyAuditLog([]string{path}, nil); err != nil || count != 6 {
+		t.Errorf("verified %d events: %v", count, err)
+	}
+}
+
+func TestAuditLogKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pubkeyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	keyPath := filepath.Join(dir, "audit.key")
+	if err := ioutil.WriteFile(keyPath, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := loadAuditKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewAuditLog(path, 0, 0, true, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAuditEvents(t, a, 3)
+	a.file.Close()
+	if count, err := verifyAuditLog([]string{path}, key); err != nil || count != 3 {
+		t.Errorf("verified %d events: %v", count, err)
+	}
+	if _, err := verifyAuditLog([]string{path}, nil); err == nil {
+		t.Error("verified a keyed chain without the key")
+	}
+
+	// an edited event with a recomputed plain hash is detected
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	hashed, _, ok := splitAuditHash(bytes.TrimSuffix(lines[2], []byte("\n")))
+	if !ok {
+		t.Fatal("last event has no hash")
+	}
+	hashed = bytes.Replace(hashed, []byte(`"status":200`), []byte(`"status":404`), 1)
+	lines[2] = append(append(hashed[:len(hashed)-1], []byte(`,"hash":"`+auditHash(nil, hashed)+`"}`)...), '\n')
+	if err := ioutil.WriteFile(path, bytes.Join(lines, nil), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyAuditLog([]string{path}, key); err == nil || !strings.Contains(err.Error(), "modified") {
+		t.Errorf("expected the edited event to be detected, got %v", err)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// API token scopes, admin grants all of them
+const (
+	scopeRead    = "read"
+	scopePurge   = "purge"
+	scopeRefresh = "refresh"
+	scopeAdmin   = "admin"
+)
+
+type contextKey string
+
+const tokenNameKey contextKey = "token"
+
+var (
+	metricAuthenticatedRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubkeyd_authenticated_requests_total",
+		Help: "Number of requests authenticated with an API token, partitioned by token name and scope.",
+	}, []string{"token", "scope"},
+	)
+	metricAuthFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubkeyd_auth_failures_total",
+		Help: "Number of requests refused for lack of a valid API token, partitioned by scope and reason.",
+	}, []string{"scope", "reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricAuthenticatedRequestsTotal)
+	prometheus.MustRegister(metricAuthFailuresTotal)
+}
+
+// APIToken is a token clients authenticate with
+type APIToken struct {
+	Token  string   `json:"token"`
+	Scopes []string `json:"scopes"`
+}
+
+// grants reports whether the token may be used for scope
+func (t APIToken) grants(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == scopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator checks the API tokens of requests. Tokens are read from a
+// JSON file mapping token names to tokens, reloaded on change:
+//
+//	{
+//	  "fleet": {"token": "...", "scopes": ["read"]},
+//	  "ops": {"token": "...", "scopes": ["admin"]}
+//	}
+//
+// The -auth and -refresh-auth tokens are added as the tokens named auth and
+// refresh-auth, the file can't use these names for other tokens. Without a tokens file a scope that none of them grants needs
+// no token, like it did before there were scopes.
+type Authenticator struct {
+	Path   string
+	Legacy map[string]APIToken
+
+	mutex  sync.RWMutex
+	tokens map[string]APIToken
+}
+
+// legacyTokens returns the -auth and -refresh-auth tokens. The auth token
+// may also refresh unless there is a refresh-auth token.
+func legacyTokens(auth string, refreshAuth string) map[string]APIToken {
+	tokens := make(map[string]APIToken)
+	if auth != "" {
+		scopes := []string{scopeRead, scopePurge}
+		if refreshAuth == "" {
+			scopes = append(scopes, scopeRefresh)
+		}
+		tokens["auth"] = APIToken{Token: auth, Scopes: scopes}
+	}
+	if refreshAuth != "" {
+		tokens["refresh-auth"] = APIToken{Token: refreshAuth, Scopes: []string{scopeRefresh}}
+	}
+	return tokens
+}
+
+// NewAuthenticator loads the tokens file at path, if any
+func NewAuthenticator(path string, legacy map[string]APIToken) (*Authenticator, error) {
+	a := &Authenticator{Path: path, Legacy: legacy}
+	if path == "" {
+		a.tokens = legacy
+		return a, nil
+	}
+	return a, a.load()
+}
+
+func (a *Authenticator) load() error {
+	data, err := ioutil.ReadFile(a.Path)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %v", a.Path, err)
+	}
+	var tokens map[string]APIToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return fmt.Errorf("Failed to parse %s: %v", a.Path, err)
+	}
+	for name, token := range tokens {
+		if token.Token == "" {
+			return fmt.Errorf("Token %s in %s is empty", name, a.Path)
+		}
+		for _, scope := range token.Scopes {
+			switch scope {
+			case scopeRead, scopePurge, scopeRefresh, scopeAdmin:
+			default:
+				return fmt.Errorf("Token %s in %s has unknown scope %s", name, a.Path, scope)
+			}
+		}
+	}
+	for name, token := range a.Legacy {
+		if _, ok := tokens[name]; ok {
+			return fmt.Errorf("Token %s in %s is already set with -%s", name, a.Path, name)
+		}
+		tokens[name] = token
+	}
+	a.mutex.Lock()
+	a.tokens = tokens
+	a.mutex.Unlock()
+	log.Infof("Loaded %d API tokens", len(tokens))
+	return nil
+}
+
+// Watch reloads the tokens whenever the file changes
+func (a *Authenticator) Watch(interval time.Duration) {
+	watchPath(a.Path, interval, func() {
+		if err := a.load(); err != nil {
+			log.Errorf("Keeping previous API tokens: %v", err)
+		}
+	})
+}
+
+// authenticate returns the name of the token a request carries in the
+// Authorization header or the auth query parameter
+func (a *Authenticator) authenticate(r *http.Request) (string, APIToken, bool) {
+	presented := ""
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		presented = strings.TrimPrefix(header, "Bearer ")
+	} else {
+		presented = r.URL.Query().Get("auth")
+	}
+	if presented == "" {
+		return "", APIToken{}, false
+	}
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	found := ""
+	for name, token := range a.tokens {
+		// compare with every token to not reveal which one matched
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(token.Token)) == 1 {
+			found = name
+		}
+	}
+	if found == "" {
+		return "", APIToken{}, false
+	}
+	return found, a.tokens[found], true
+}
+
+// open reports whether scope needs no token
+func (a *Authenticator) open(scope string) bool {
+	if a.Path != "" {
+		return false
+	}
+	for _, token := range a.Legacy {
+		if token.grants(scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// require returns middleware that refuses requests without a token
+// granting scope
+func (a *Authenticator) require(scope string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name, token, ok := a.authenticate(r)
+			switch {
+			case ok && token.grants(scope):
+				log.Infof("Request %s %s from %s authenticated with token %s", r.Method, r.URL.Path, clientHost(r), name)
+				metricAuthenticatedRequestsTotal.WithLabelValues(name, scope).Inc()
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenNameKey, name)))
+			case a.open(scope):
+				next.ServeHTTP(w, r)
+			case ok:
+				log.Errorf("Refusing %s %s from %s, token %s lacks scope %s", r.Method, r.URL.Path, clientHost(r), name, scope)
+				metricAuthFailuresTotal.WithLabelValues(scope, "scope").Inc()
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte("403 token lacks scope " + scope + "\n"))
+			default:
+				log.Errorf("Refusing %s %s from %s without valid token", r.Method, r.URL.Path, clientHost(r))
+				metricAuthFailuresTotal.WithLabelValues(scope, "token").Inc()
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte("401 valid token required\n"))
+			}
+		})
+	}
+}
+
+// requireAdmin returns middleware for admin actions, which without a tokens
+// file need the legacy token that may refresh. Unlike other scopes admin
+// actions are never open: if no token grants them all requests are refused.
+func (a *Authenticator) requireAdmin() mux.MiddlewareFunc {
+	scope := scopeAdmin
+	if a.Path == "" {
+		scope = scopeRefresh
+	}
+	require := a.require(scope)
+	return func(next http.Handler) http.Handler {
+		authenticated := require(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if a.open(scope) {
+				log.Errorf("Refusing %s %s from %s, no token grants scope %s", r.Method, r.URL.Path, clientHost(r), scope)
+				metricAuthFailuresTotal.WithLabelValues(scope, "disabled").Inc()
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte("403 no token grants scope " + scope + "\n"))
+				return
+			}
+			authenticated.ServeHTTP(w, r)
+		})
+	}
+}
+
+// tokenName returns the name of the token a request was authenticated with
+func tokenName(r *http.Request) string {
+	name, _ := r.Context().Value(tokenNameKey).(string)
+	return name
+}
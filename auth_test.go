@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// authStatus returns the status of a request for scope with the token in
+// the Authorization header, and the name of the token the handler saw
+func authStatus(a *Authenticator, scope string, token string) (int, string) {
+	name := ""
+	handler := a.require(scope)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name = tokenName(r)
+	}))
+	r := httptest.NewRequest("GET", "/authorized_keys/alice", nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w.Code, name
+}
+
+func TestAuthenticatorScopes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pubkeyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens.json")
+	tokens := `{
+		"fleet": {"token": "fleet-token", "scopes": ["read"]},
+		"ops": {"token": "ops-token", "scopes": ["admin"]}
+	}`
+	if err := ioutil.WriteFile(path, []byte(tokens), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAuthenticator(path, legacyTokens("legacy-token", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		scope  string
+		token  string
+		status int
+		name   string
+	}{
+		{scopeRead, "fleet-token", http.StatusOK, "fleet"},
+		{scopePurge, "fleet-token", http.StatusForbidden, ""},
+		{scopeRefresh, "ops-token", http.StatusOK, "ops"},
+		{scopeAdmin, "ops-token", http.StatusOK, "ops"},
+		{scopeRefresh, "legacy-token", http.StatusOK, "auth"},
+		{scopeAdmin, "legacy-token", http.StatusForbidden, ""},
+		{scopeRead, "", http.StatusUnauthorized, ""},
+		{scopeRead, "wrong-token", http.StatusUnauthorized, ""},
+	} {
+		if status, name := authStatus(a, test.scope, test.token); status != test.status || name != test.name {
+			t.Errorf("scope %s with token %q: got %d for token %q, want %d for %q", test.scope, test.token, status, name, test.status, test.name)
+		}
+	}
+	r := httptest.NewRequest("GET", "/authorized_keys/alice?auth=fleet-token", nil)
+	if name, _, ok := a.authenticate(r); !ok || name != "fleet" {
+		t.Errorf("the auth parameter authenticated %q, %v", name, ok)
+	}
+
+	// the tokens are reloaded, an invalid file keeps the previous ones
+	if err := ioutil.WriteFile(path, []byte(`{"fleet": {"token": "new-token", "scopes": ["read"]}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.load(); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := authStatus(a, scopeRead, "fleet-token"); status != http.StatusUnauthorized {
+		t.Errorf("got %d for the replaced token", status)
+	}
+	for _, invalid := range []string{
+		`{"fleet": {"token": "", "scopes": ["read"]}}`,
+		`{"fleet": {"token": "other-token", "scopes": ["write"]}}`,
+		`{"auth": {"token": "other-token", "scopes": ["read"]}}`,
+		`not json`,
+	} {
+		if err := ioutil.WriteFile(path, []byte(invalid), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.load(); err == nil {
+			t.Errorf("loaded %s", invalid)
+		}
+		if status, name := authStatus(a, scopeRead, "new-token"); status != http.StatusOK || name != "fleet" {
+			t.Errorf("got %d for %q after loading %s, want the previous tokens", status, name, invalid)
+		}
+	}
+	if err := ioutil.WriteFile(path, []byte(`{"auth": {"token": "other-token", "scopes": ["read"]}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewAuthenticator(path, legacyTokens("legacy-token", "")); err == nil || !strings.Contains(err.Error(), "-auth") {
+		t.Errorf("expected the auth token of the file to collide with -auth, got %v", err)
+	}
+}
+
+func TestAuthenticatorLegacy(t *testing.T) {
+	if got, want := legacyTokens("a", ""), map[string]APIToken{
+		"auth": {Token: "a", Scopes: []string{scopeRead, scopePurge, scopeRefresh}},
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := legacyTokens("a", "r"), map[string]APIToken{
+		"auth":         {Token: "a", Scopes: []string{scopeRead, scopePurge}},
+		"refresh-auth": {Token: "r", Scopes: []string{scopeRefresh}},
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// without a tokens file a scope that no legacy token grants is open
+	for _, test := range []struct {
+		auth, refreshAuth string
+		open              []string
+	}{
+		{"", "", []string{scopeRead, scopePurge, scopeRefresh, scopeAdmin}},
+		{"a", "", []string{scopeAdmin}},
+		{"a", "r", []string{scopeAdmin}},
+		{"", "r", []string{scopeRead, scopePurge, scopeAdmin}},
+	} {
+		a, err := NewAuthenticator("", legacyTokens(test.auth, test.refreshAuth))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var open []string
+		for _, scope := range []string{scopeRead, scopePurge, scopeRefresh, scopeAdmin} {
+			status, _ := authStatus(a, scope, "")
+			if status == http.StatusOK {
+				open = append(open, scope)
+			} else if status != http.StatusUnauthorized {
+				t.Errorf("-auth %q -refresh-auth %q: got %d for scope %s without a token", test.auth, test.refreshAuth, status, scope)
+			}
+		}
+		if !reflect.DeepEqual(open, test.open) {
+			t.Errorf("-auth %q -refresh-auth %q: got open scopes %v, want %v", test.auth, test.refreshAuth, open, test.open)
+		}
+	}
+	a, err := NewAuthenticator("", legacyTokens("a", "r"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := authStatus(a, scopeRefresh, "a"); status != http.StatusForbidden {
+		t.Errorf("got %d for refreshing with -auth next to -refresh-auth", status)
+	}
+}
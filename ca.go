@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"pubkeyd/sshsig"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// SSHSIG namespace of certificate requests
+	caSignNamespace = "pubkeyd-ca"
+	// how far the timestamp of a certificate request may be off
+	caMaxClockSkew = 5 * time.Minute
+	// certificates are backdated by this much to tolerate clock skew on hosts
+	caBackdate = 5 * time.Minute
+	// prefix of role principals, so that roles can't name local accounts
+	caRolePrefix = "role:"
+)
+
+var metricCARequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "pubkeyd_ca_requests_total",
+	Help: "Number of SSH certificate requests, partitioned by status code and HTTP method.",
+}, []string{"code", "method"},
+)
+
+func init() {
+	prometheus.MustRegister(metricCARequestsTotal)
+}
+
+// CertificateAuthority issues short-lived OpenSSH user certificates to
+// users who prove that they hold one of their known keys
+type CertificateAuthority struct {
+	Signer ssh.Signer
+	// how long issued certificates are valid
+	Validity time.Duration
+	// certificate extensions like permit-pty
+	Extensions []string
+	// add the users roles as role:<name> principals next to the username
+	RolePrincipals bool
+}
+
+// NewCertificateAuthority loads the CA private key from path. Only ed25519
+// and ECDSA keys are accepted, the vendored SSH library signs with RSA keys
+// using SHA-1 which current OpenSSH rejects.
+func NewCertificateAuthority(path string, validity time.Duration, extensions []string, rolePrincipals bool) (*CertificateAuthority, error) {
+	pemBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read CA key: %v", err)
+	}
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse CA key: %v", err)
+	}
+	switch keyType := signer.PublicKey().Type(); keyType {
+	case ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+	default:
+		return nil, fmt.Errorf("Unsupported CA key type %s, use an ed25519 or ECDSA key", keyType)
+	}
+	return &CertificateAuthority{
+		Signer:         signer,
+		Validity:       validity,
+		Extensions:     extensions,
+		RolePrincipals: rolePrincipals,
+	}, nil
+}
+
+// Register adds the CA routes to router. Certificate requests are
+// authenticated by their signature so they don't need the auth token.
+func (ca *CertificateAuthority) Register(router *mux.Router) {
+	router.HandleFunc("/ca/public_key", ca.getPublicKey).Methods("GET")
+	router.HandleFunc("/ca/sign", ca.sign).Methods("POST")
+}
+
+func (ca *CertificateAuthority) getPublicKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	w.Write(ssh.MarshalAuthorizedKey(ca.Signer.PublicKey()))
+	metricCARequestsTotal.WithLabelValues("200", "GET").Inc()
+}
+
+// sign issues a certificate for the key that signed the request. The form
+// values are user, timestamp (unix seconds) and signature, an SSHSIG made
+// with ssh-keygen -Y sign -n pubkeyd-ca over "<user>:<timestamp>".
+func (ca *CertificateAuthority) sign(w http.ResponseWriter, r *http.Request) {
+	user := r.FormValue("user")
+	timestamp := r.FormValue("timestamp")
+	w.Header().Set("Content-Type", "text/plain")
+
+	signature, err := sshsig.Parse([]byte(r.FormValue("signature")))
+	if err != nil {
+		ca.fail(w, http.StatusBadRequest, "400 invalid signature", fmt.Errorf("Certificate request for user %s: %v", user, err))
+		return
+	}
+	if err := signature.Verify(caSignNamespace, []byte(user+":"+timestamp)); err != nil {
+		ca.fail(w, http.StatusForbidden, "403 signature verification failed", fmt.Errorf("Certificate request for user %s: %v", user, err))
+		return
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(unix, 0)) > caMaxClockSkew || time.Until(time.Unix(unix, 0)) > caMaxClockSkew {
+		ca.fail(w, http.StatusForbidden, "403 timestamp out of range", fmt.Errorf("Certificate request for user %s with timestamp %s", user, timestamp))
+		return
+	}
+
+	refreshMutex.RLock()
+	u, ok := users[user]
+	refreshMutex.RUnlock()
+	// the CA stays with the main identity provider
+	if !ok || userTenant(user) != "" {
+		ca.fail(w, http.StatusNotFound, "404 user not found", fmt.Errorf("Certificate request for unknown user %s", user))
+		return
+	}
+	// a key removed upstream must not get a certificate from stale keys
+	authorizedKeys, err := freshAuthorizedKeys(user, u)
+	if err != nil {
+		ca.fail(w, http.StatusServiceUnavailable, "503 couldn't retrieve users authorized_keys", fmt.Errorf("Certificate request for user %s: %v", user, err))
+		return
+	}
+	if !containsKey(authorizedKeys, signature.PublicKey) {
+		ca.fail(w, http.StatusForbidden, "403 key not known for user", fmt.Errorf("Certificate request for user %s signed with unknown key %s", user, ssh.FingerprintSHA256(signature.PublicKey)))
+		return
+	}
+
+	cert, err := ca.issue(user, u, signature.PublicKey)
+	if err != nil {
+		ca.fail(w, http.StatusInternalServerError, "500 couldn't sign certificate", err)
+		return
+	}
+	log.Infof("Issued certificate with principals %s to user %s for key %s", strings.Join(cert.ValidPrincipals, ","), user, ssh.FingerprintSHA256(signature.PublicKey))
+	w.WriteHeader(http.StatusOK)
+	w.Write(ssh.MarshalAuthorizedKey(cert))
+	metricCARequestsTotal.WithLabelValues("200", "POST").Inc()
+}
+
+func (ca *CertificateAuthority) issue(user string, u User, key ssh.PublicKey) (*ssh.Certificate, error) {
+	principals := []string{user}
+	if ca.RolePrincipals {
+		for _, role := range u.Roles {
+			principals = append(principals, caRolePrefix+role)
+		}
+	}
+	extensions := make(map[string]string)
+	for _, extension := range ca.Extensions {
+		extensions[extension] = ""
+	}
+	serial := make([]byte, 8)
+	if _, err := rand.Read(serial); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          binary.BigEndian.Uint64(serial),
+		CertType:        ssh.UserCert,
+		KeyId:           user,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Add(-caBackdate).Unix()),
+		ValidBefore:     uint64(now.Add(ca.Validity).Unix()),
+		Permissions:     ssh.Permissions{Extensions: extensions},
+	}
+	if err := cert.SignCert(rand.Reader, ca.Signer); err != nil {
+		return nil, fmt.Errorf("Failed to sign certificate for user %s: %v", user, err)
+	}
+	return cert, nil
+}
+
+func (ca *CertificateAuthority) fail(w http.ResponseWriter, status int, message string, err error) {
+	log.Error(err)
+	w.WriteHeader(status)
+	w.Write([]byte(message + "\n"))
+	metricCARequestsTotal.WithLabelValues(strconv.Itoa(status), "POST").Inc()
+}
+
+// containsKey reports whether key is one of the entries of authorizedKeys
+func containsKey(authorizedKeys string, key ssh.PublicKey) bool {
+	wanted := string(key.Marshal())
+	rest := []byte(authorizedKeys)
+	for len(rest) > 0 {
+		known, _, _, next, err := ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			return false
+		}
+		if string(known.Marshal()) == wanted {
+			return true
+		}
+		rest = next
+	}
+	return false
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"pubkeyd/sshsig"
+
+	"github.com/patrickmn/go-cache"
+	"golang.org/x/crypto/ssh"
+)
+
+// writeCAKey writes key as PEM block of type blockType and returns its path
+func writeCAKey(t *testing.T, dir string, blockType string, der []byte) string {
+	path := filepath.Join(dir, blockType)
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCertificateAuthorityKeyTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pubkeyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPath := writeCAKey(t, dir, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+	if _, err := NewCertificateAuthority(rsaPath, time.Hour, nil, false); err == nil || !strings.Contains(err.Error(), "ssh-rsa") {
+		t.Errorf("expected RSA CA key to be refused, got %v", err)
+	}
+
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(ecdsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := NewCertificateAuthority(writeCAKey(t, dir, "EC PRIVATE KEY", der), time.Hour, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userKey, err := ssh.NewPublicKey(&ecdsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ca.issue("alice", User{Roles: []string{"ops", "bob"}}, userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"alice", "role:ops", "role:bob"}; !reflect.DeepEqual(cert.ValidPrincipals, want) {
+		t.Errorf("got principals %v, want %v", cert.ValidPrincipals, want)
+	}
+	ca.RolePrincipals = false
+	if cert, err = ca.issue("alice", User{Roles: []string{"ops"}}, userKey); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"alice"}; !reflect.DeepEqual(cert.ValidPrincipals, want) {
+		t.Errorf("got principals %v without role principals, want %v", cert.ValidPrincipals, want)
+	}
+}
+
+// rsaSHA2Signer signs with rsa-sha2-512 like current OpenSSH does
+type rsaSHA2Signer struct {
+	key *rsa.PrivateKey
+}
+
+func (s rsaSHA2Signer) PublicKey() ssh.PublicKey {
+	key, _ := ssh.NewPublicKey(&s.key.PublicKey)
+	return key
+}
+
+func (s rsaSHA2Signer) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	h := sha512.Sum512(data)
+	blob, err := rsa.SignPKCS1v15(rand, s.key, crypto.SHA512, h[:])
+	if err != nil {
+		return nil, err
+	}
+	return &ssh.Signature{Format: "rsa-sha2-512", Blob: blob}, nil
+}
+
+// signCARequest returns the form of a certificate request as ssh-keygen -Y
+// sign would create it, signed in namespace over message
+func signCARequest(t *testing.T, signer ssh.Signer, namespace string, user string, timestamp string, message string) url.Values {
+	blob, err := sshsig.SignBlob(signer, namespace, []byte(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return url.Values{
+		"user":      {user},
+		"timestamp": {timestamp},
+		"signature": {string(pem.EncodeToMemory(&pem.Block{Type: sshsig.PEMType, Bytes: blob}))},
+	}
+}
+
+// postCARequest posts form to the sign handler of ca
+func postCARequest(ca *CertificateAuthority, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/ca/sign", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	ca.sign(w, r)
+	return w
+}
+
+func TestCertificateAuthoritySign(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pubkeyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := NewCertificateAuthority(writeCAKey(t, dir, "EC PRIVATE KEY", der), time.Hour, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var signers []ssh.Signer
+	for i := 0; i < 2; i++ {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers = append(signers, signer)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaSigner, unknownSigner, rsaSigner := signers[0], signers[1], rsaSHA2Signer{rsaKey}
+
+	source := &fakeKeySource{keys: map[string]string{
+		"alice": string(ssh.MarshalAuthorizedKey(ecdsaSigner.PublicKey())) + string(ssh.MarshalAuthorizedKey(rsaSigner.PublicKey())),
+	}}
+	keySources["fake"] = source
+	defer delete(keySources, "fake")
+	pubkeyCache = cache.New(time.Minute, time.Minute)
+	defer func() { users = nil }()
+	users = map[string]User{
+		"alice":                         {Accounts: map[string]string{"fake": "alice"}},
+		tenantQualified("sub", "alice"): {Accounts: map[string]string{"fake": "alice"}},
+	}
+	tenantAlice := tenantQualified("sub", "alice")
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-2*caMaxClockSkew).Unix(), 10)
+	for _, test := range []struct {
+		name   string
+		form   url.Values
+		status int
+	}{
+		{"ecdsa", signCARequest(t, ecdsaSigner, caSignNamespace, "alice", now, "alice:"+now), http.StatusOK},
+		{"rsa-sha2-512", signCARequest(t, rsaSigner, caSignNamespace, "alice", now, "alice:"+now), http.StatusOK},
+		{"unsigned", url.Values{"user": {"alice"}, "timestamp": {now}}, http.StatusBadRequest},
+		{"other namespace", signCARequest(t, ecdsaSigner, "file", "alice", now, "alice:"+now), http.StatusForbidden},
+		{"other message", signCARequest(t, ecdsaSigner, caSignNamespace, "alice", now, "bob:"+now), http.StatusForbidden},
+		{"old timestamp", signCARequest(t, ecdsaSigner, caSignNamespace, "alice", old, "alice:"+old), http.StatusForbidden},
+		{"unknown user", signCARequest(t, ecdsaSigner, caSignNamespace, "bob", now, "bob:"+now), http.StatusNotFound},
+		{"unknown key", signCARequest(t, unknownSigner, caSignNamespace, "alice", now, "alice:"+now), http.StatusForbidden},
+		// the CA stays with the main identity provider
+		{"tenant user", signCARequest(t, ecdsaSigner, caSignNamespace, tenantAlice, now, tenantAlice+":"+now), http.StatusNotFound},
+	} {
+		w := postCARequest(ca, test.form)
+		if w.Code != test.status {
+			t.Errorf("%s: got status %d, want %d: %s", test.name, w.Code, test.status, w.Body)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey(w.Body.Bytes())
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		cert, ok := key.(*ssh.Certificate)
+		if !ok || !reflect.DeepEqual(cert.ValidPrincipals, []string{"alice"}) || string(cert.SignatureKey.Marshal()) != string(ca.Signer.PublicKey().Marshal()) {
+			t.Errorf("%s: got %s", test.name, w.Body)
+		}
+	}
+
+	// keys older than SoftTTL are fetched again, a key removed upstream or a
+	// failing key source gets no certificate from the cached keys
+	stale := func() {
+		cached, _ := pubkeyCache.Get("alice")
+		entry := cached.(cachedKeys)
+		entry.Fetched = time.Now().Add(-keyCache.SoftTTL - time.Second)
+		pubkeyCache.Set("alice", entry, cache.DefaultExpiration)
+	}
+	stale()
+	source.mutex.Lock()
+	source.keys["alice"] = string(ssh.MarshalAuthorizedKey(ecdsaSigner.PublicKey()))
+	source.mutex.Unlock()
+	if w := postCARequest(ca, signCARequest(t, rsaSigner, caSignNamespace, "alice", now, "alice:"+now)); w.Code != http.StatusForbidden {
+		t.Errorf("got status %d for a key removed upstream, want 403", w.Code)
+	}
+
+	stale()
+	source.mutex.Lock()
+	source.err = errors.New("unreachable")
+	source.mutex.Unlock()
+	if w := postCARequest(ca, signCARequest(t, ecdsaSigner, caSignNamespace, "alice", now, "alice:"+now)); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d with stale keys and a failing key source, want 503", w.Code)
+	}
+}
@@ -0,0 +1,145 @@
+// pubkeyd-verify fetches the authorized_keys of a user from pubkeyd and
+// prints them only if they carry a valid signature of the pubkeyd signing
+// key, for use as sshd AuthorizedKeysCommand:
+//
+//	AuthorizedKeysCommand /usr/local/bin/pubkeyd-verify -url https://pubkey.example.com -public-key /etc/ssh/pubkeyd_signing.pub %u
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"pubkeyd/sshsig"
+
+	"github.com/op/go-logging"
+	"golang.org/x/crypto/ssh"
+)
+
+const maxBodySize = 1 << 20
+
+var log = logging.MustGetLogger("pubkeyd-verify")
+
+func main() {
+	baseURL := flag.String("url", "", "pubkeyd URL, e.g. https://pubkey.example.com")
+	publicKeyFile := flag.String("public-key", "", "File with the pubkeyd signing public key as served at /signing_key")
+	tokenFile := flag.String("token-file", "", "File with the API token")
+	hostToken := flag.String("host-token", "", "Host group token")
+	tenant := flag.String("tenant", "", "Tenant of the user if it isn't one of the main identity provider")
+	caFile := flag.String("ca", "", "PEM file of CAs to trust instead of the system roots")
+	certFile := flag.String("cert", "", "TLS client certificate file")
+	keyFile := flag.String("key", "", "TLS client key file")
+	maxAge := flag.Int("max-age", 300, "Maximum age of a response in seconds")
+	timeout := flag.Int("timeout", 10, "Request timeout in seconds")
+	flag.Parse()
+
+	if *baseURL == "" || *publicKeyFile == "" || flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s -url URL -public-key FILE [options] USER\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	user := flag.Arg(0)
+
+	publicKeyBytes, err := ioutil.ReadFile(*publicKeyFile)
+	if err != nil {
+		fail("Failed to read public key: %v", err)
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(publicKeyBytes)
+	if err != nil {
+		fail("Failed to parse public key: %v", err)
+	}
+	token := ""
+	if *tokenFile != "" {
+		tokenBytes, err := ioutil.ReadFile(*tokenFile)
+		if err != nil {
+			fail("Failed to read token: %v", err)
+		}
+		token = strings.TrimSpace(string(tokenBytes))
+	}
+	client, err := newClient(*caFile, *certFile, *keyFile, time.Duration(*timeout)*time.Second)
+	if err != nil {
+		fail("%v", err)
+	}
+
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		fail("Failed to create nonce: %v", err)
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+	path := "/authorized_keys/" + url.PathEscape(user)
+	if *tenant != "" {
+		// responses of tenant routes are signed for tenant/user
+		path = "/t/" + url.PathEscape(*tenant) + path
+		user = *tenant + "/" + user
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(*baseURL, "/")+path, nil)
+	if err != nil {
+		fail("%v", err)
+	}
+	req.Header.Set(sshsig.NonceHeader, nonce)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if *hostToken != "" {
+		req.Header.Set("X-Host-Token", *hostToken)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		fail("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fail("pubkeyd returned %s for user %s", resp.Status, user)
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, maxBodySize))
+	if err != nil {
+		fail("Failed to read response: %v", err)
+	}
+
+	if err := sshsig.VerifyResponse(publicKey, user, nonce, time.Duration(*maxAge)*time.Second, resp.Header, body); err != nil {
+		fail("Rejecting authorized_keys of user %s: %v", user, err)
+	}
+	os.Stdout.Write(body)
+}
+
+func newClient(caFile, certFile, keyFile string, timeout time.Duration) (*http.Client, error) {
+	config := &tls.Config{}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read CAs: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", caFile)
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: config,
+		},
+	}, nil
+}
+
+func fail(format string, args ...interface{}) {
+	log.Errorf(format, args...)
+	os.Exit(1)
+}
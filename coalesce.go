@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	accountFetches = &fetchGroup{calls: make(map[string]*fetchCall)}
+
+	metricCoalescedFetchesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubkeyd_coalesced_fetches_total",
+		Help: "Number of key fetches that waited for an identical fetch in flight instead of calling the key source, partitioned by key source.",
+	}, []string{"source"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricCoalescedFetchesTotal)
+}
+
+type fetchCall struct {
+	done chan struct{}
+	keys string
+	err  error
+}
+
+// fetchGroup makes concurrent fetches of the same account share a single
+// call to the key source
+type fetchGroup struct {
+	mutex sync.Mutex
+	calls map[string]*fetchCall
+}
+
+// do calls fetch unless a fetch of a is already in flight, in which case it
+// waits for that fetch and returns its result
+func (g *fetchGroup) do(a account, fetch func() (string, error)) (string, error) {
+	key := a.source + ":" + a.name
+	g.mutex.Lock()
+	if call, ok := g.calls[key]; ok {
+		g.mutex.Unlock()
+		metricCoalescedFetchesTotal.WithLabelValues(a.source).Inc()
+		log.Debugf("Waiting for keys of %s account %s being fetched", a.source, a.name)
+		<-call.done
+		return call.keys, call.err
+	}
+	call := &fetchCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mutex.Unlock()
+
+	call.keys, call.err = fetch()
+	g.mutex.Lock()
+	delete(g.calls, key)
+	g.mutex.Unlock()
+	close(call.done)
+	return call.keys, call.err
+}
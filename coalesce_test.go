@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// counterValue returns the current value of c
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestFetchGroup(t *testing.T) {
+	const waiters = 5
+	coalesced := metricCoalescedFetchesTotal.WithLabelValues("fake")
+	for _, fetchErr := range []error{nil, errors.New("rate limited")} {
+		g := &fetchGroup{calls: make(map[string]*fetchCall)}
+		started := make(chan struct{})
+		release := make(chan struct{})
+		var callsMutex sync.Mutex
+		calls := 0
+		fetch := func() (string, error) {
+			callsMutex.Lock()
+			calls++
+			callsMutex.Unlock()
+			close(started)
+			<-release
+			if fetchErr != nil {
+				return "", fetchErr
+			}
+			return testGithubKey + "\n", nil
+		}
+		before := counterValue(t, coalesced)
+
+		type result struct {
+			keys string
+			err  error
+		}
+		results := make(chan result, waiters+1)
+		do := func(a account) {
+			keys, err := g.do(a, fetch)
+			results <- result{keys, err}
+		}
+		go do(account{"fake", "alice"})
+		<-started
+		for i := 0; i < waiters; i++ {
+			go do(account{"fake", "alice"})
+		}
+		// release the fetch once every waiter joined it
+		for deadline := time.Now().Add(5 * time.Second); counterValue(t, coalesced)-before < waiters; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("only %v of %d fetches waited", counterValue(t, coalesced)-before, waiters)
+			}
+		}
+		close(release)
+
+		for i := 0; i < waiters+1; i++ {
+			r := <-results
+			if r.err != fetchErr || (r.err == nil) != (r.keys == testGithubKey+"\n") {
+				t.Errorf("got %q, %v, want %v", r.keys, r.err, fetchErr)
+			}
+		}
+		if calls != 1 {
+			t.Errorf("called the key source %d times, want once", calls)
+		}
+		if len(g.calls) != 0 {
+			t.Errorf("fetches still in flight: %v", g.calls)
+		}
+	}
+
+	// other accounts of the same source don't wait for each other
+	g := &fetchGroup{calls: make(map[string]*fetchCall)}
+	block := make(chan struct{})
+	go g.do(account{"fake", "alice"}, func() (string, error) { <-block; return "", nil })
+	defer close(block)
+	done := make(chan struct{})
+	go func() {
+		g.do(account{"fake", "bob"}, func() (string, error) { return "", nil })
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("the fetch of bob waited for the fetch of alice")
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	metricIndexedFingerprints = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "pubkeyd_indexed_fingerprints",
+		Help: "Number of keys in the fingerprint index.",
+	})
+	metricFingerprintRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubkeyd_fingerprint_requests_total",
+		Help: "Number of fingerprint requests, partitioned by status code and HTTP method.",
+	}, []string{"code", "method"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricIndexedFingerprints)
+	prometheus.MustRegister(metricFingerprintRequestsTotal)
+}
+
+// FingerprintEntry describes a key pubkeyd has served
+type FingerprintEntry struct {
+	// tenant the user belongs to, empty for the main identity provider
+	Tenant     string `json:"tenant,omitempty"`
+	User       string `json:"user"`
+	GithubName string `json:"github,omitempty"`
+	Type       string `json:"type"`
+	SHA256     string `json:"sha256"`
+	MD5        string `json:"md5"`
+}
+
+// FingerprintIndex maps the SHA256 and MD5 fingerprints of every key that
+// was served to the users owning it
+type FingerprintIndex struct {
+	mutex sync.RWMutex
+	// entries by SHA256 fingerprint, then by user
+	entries map[string]map[string]FingerprintEntry
+	// MD5 to SHA256 fingerprint
+	md5 map[string]string
+	// SHA256 fingerprints by user
+	users map[string][]string
+}
+
+// NewFingerprintIndex returns an empty index
+func NewFingerprintIndex() *FingerprintIndex {
+	return &FingerprintIndex{
+		entries: make(map[string]map[string]FingerprintEntry),
+		md5:     make(map[string]string),
+		users:   make(map[string][]string),
+	}
+}
+
+// update replaces the indexed keys of user with the keys in authorizedKeys
+func (f *FingerprintIndex) update(user string, u User, authorizedKeys string) {
+	var entries []FingerprintEntry
+	tenant, name := splitUser(user)
+	rest := []byte(authorizedKeys)
+	for len(rest) > 0 {
+		key, _, _, next, err := ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			break
+		}
+		rest = next
+		entries = append(entries, FingerprintEntry{
+			Tenant:     tenant,
+			User:       name,
+			GithubName: u.GithubName,
+			Type:       key.Type(),
+			SHA256:     ssh.FingerprintSHA256(key),
+			MD5:        "MD5:" + ssh.FingerprintLegacyMD5(key),
+		})
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, sha256 := range f.users[user] {
+		md5 := f.entries[sha256][user].MD5
+		delete(f.entries[sha256], user)
+		if len(f.entries[sha256]) == 0 {
+			delete(f.entries, sha256)
+			delete(f.md5, md5)
+		}
+	}
+	var fingerprints []string
+	for _, entry := range entries {
+		if f.entries[entry.SHA256] == nil {
+			f.entries[entry.SHA256] = make(map[string]FingerprintEntry)
+		}
+		f.entries[entry.SHA256][user] = entry
+		f.md5[entry.MD5] = entry.SHA256
+		fingerprints = append(fingerprints, entry.SHA256)
+	}
+	if len(fingerprints) > 0 {
+		f.users[user] = fingerprints
+	} else {
+		delete(f.users, user)
+	}
+	metricIndexedFingerprints.Set(float64(len(f.entries)))
+}
+
+// forget drops the keys of a user that is gone
+func (f *FingerprintIndex) forget(user string) {
+	f.update(user, User{}, "")
+}
+
+// lookup returns the users owning the key with fingerprint, either
+// SHA256:... or MD5:... or the bare hex MD5 fingerprint ssh-keygen -E md5
+// used to print
+func (f *FingerprintIndex) lookup(fingerprint string) []FingerprintEntry {
+	if !strings.HasPrefix(fingerprint, "SHA256:") && !strings.HasPrefix(fingerprint, "MD5:") {
+		if strings.Contains(fingerprint, ":") {
+			fingerprint = "MD5:" + strings.ToLower(fingerprint)
+		} else {
+			fingerprint = "SHA256:" + fingerprint
+		}
+	}
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	if sha256, ok := f.md5[fingerprint]; ok {
+		fingerprint = sha256
+	}
+	var entries []FingerprintEntry
+	for _, entry := range f.entries[fingerprint] {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Tenant != entries[j].Tenant {
+			return entries[i].Tenant < entries[j].Tenant
+		}
+		return entries[i].User < entries[j].User
+	})
+	return entries
+}
+
+// crawl fetches the keys of all users every interval so that the index
+// knows the keys of users that haven't logged in anywhere yet
+func (f *FingerprintIndex) crawl(interval time.Duration) {
+	for {
+		refreshMutex.RLock()
+		snapshot := make(map[string]User, len(users))
+		for user, u := range users {
+			snapshot[user] = u
+		}
+		refreshMutex.RUnlock()
+		log.Debugf("Crawling keys of %d users for the fingerprint index", len(snapshot))
+		for user, u := range snapshot {
+			if _, _, err := cachedAuthorizedKeys(user, u); err != nil {
+				log.Errorf("Failed to index keys of user %s: %v", displayUser(user), err)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+func getFingerprint(w http.ResponseWriter, r *http.Request) {
+	fingerprint := mux.Vars(r)["fp"]
+	entries := fingerprintIndex.lookup(fingerprint)
+	if len(entries) == 0 {
+		log.Errorf("Fingerprint %s not found", fingerprint)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404 fingerprint not found\n"))
+		metricFingerprintRequestsTotal.WithLabelValues("404", "GET").Inc()
+		return
+	}
+	log.Infof("Returning %d owners of fingerprint %s", len(entries), fingerprint)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(entries)
+	metricFingerprintRequestsTotal.WithLabelValues("200", "GET").Inc()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/patrickmn/go-cache"
+	"golang.org/x/crypto/ssh"
+)
+
+// sha256Fingerprint returns the SHA256 fingerprint of an authorized_keys line
+func sha256Fingerprint(t *testing.T, authorizedKey string) string {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ssh.FingerprintSHA256(key)
+}
+
+func TestFingerprintIndex(t *testing.T) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(testGithubKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha256 := ssh.FingerprintSHA256(key)
+	md5 := ssh.FingerprintLegacyMD5(key)
+	pubkeyCache = cache.New(time.Minute, time.Minute)
+	fingerprintIndex = NewFingerprintIndex()
+	fingerprintIndex.update("alice", newUser("alice-gh"), testGithubKey+"\n"+testOtherKey+"\n")
+	fingerprintIndex.update("deploy", User{}, testGithubKey+"\n")
+
+	for _, fingerprint := range []string{sha256, strings.TrimPrefix(sha256, "SHA256:"), "MD5:" + md5, md5, strings.ToUpper(md5)} {
+		entries := fingerprintIndex.lookup(fingerprint)
+		if len(entries) != 2 || entries[0].User != "alice" || entries[0].GithubName != "alice-gh" || entries[1].User != "deploy" || entries[0].SHA256 != sha256 {
+			t.Errorf("lookup of %s returned %+v", fingerprint, entries)
+		}
+	}
+
+	// a refresh without alice drops the keys of alice, the key of deploy stays
+	users = map[string]User{"alice": newUser("alice-gh"), "deploy": {}}
+	setUsers("", map[string]User{"deploy": {}})
+	if entries := fingerprintIndex.lookup(sha256); len(entries) != 1 || entries[0].User != "deploy" {
+		t.Errorf("got %+v after alice was removed", entries)
+	}
+	if entries := fingerprintIndex.lookup(sha256Fingerprint(t, testOtherKey)); len(entries) != 0 {
+		t.Errorf("got %+v for a key only alice had", entries)
+	}
+
+	deleteUser("deploy")
+	router := mux.NewRouter()
+	router.HandleFunc("/fingerprint/{fp}", getFingerprint)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/fingerprint/"+sha256, nil))
+	if w.Code != http.StatusNotFound || len(fingerprintIndex.users) != 0 || len(fingerprintIndex.md5) != 0 {
+		t.Errorf("got status %d and index %+v after all users were removed", w.Code, fingerprintIndex)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+// defaultHostGroup applies to hosts that don't identify their host group
+const defaultHostGroup = "default"
+
+// HostGroup lists the roles whose members may log in to the hosts of a group
+type HostGroup struct {
+	Roles []string `json:"roles"`
+	// tokens that identify a host as member of the group
+	Tokens []string `json:"tokens,omitempty"`
+	// patterns like *.prod.example.com matched against the names in client
+	// certificates
+	Hosts []string `json:"hosts,omitempty"`
+}
+
+// HostGroups restricts the users whose keys are returned to a host to the
+// members of the roles of the hosts group. They are read from a JSON file:
+//
+//	{
+//	  "prod": {"roles": ["ops"], "tokens": ["..."], "hosts": ["*.prod.example.com"]},
+//	  "dev": {"roles": ["ops", "engineering"]}
+//	}
+//
+// Hosts identify their group with a token in the X-Host-Token header or
+// host_token query parameter or with their TLS client certificate, or name
+// it in the host_group query parameter. Hosts that do neither belong to the
+// group "default" if there is one and are unrestricted otherwise.
+type HostGroups struct {
+	Path string
+
+	mutex  sync.RWMutex
+	groups map[string]HostGroup
+}
+
+// NewHostGroups loads the host groups from path
+func NewHostGroups(path string) (*HostGroups, error) {
+	h := &HostGroups{Path: path}
+	return h, h.load()
+}
+
+func (h *HostGroups) load() error {
+	data, err := ioutil.ReadFile(h.Path)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %v", h.Path, err)
+	}
+	var groups map[string]HostGroup
+	if err := json.Unmarshal(data, &groups); err != nil {
+		return fmt.Errorf("Failed to parse %s: %v", h.Path, err)
+	}
+	h.mutex.Lock()
+	h.groups = groups
+	h.mutex.Unlock()
+	log.Infof("Loaded %d host groups", len(groups))
+	return nil
+}
+
+// Watch reloads the host groups whenever the file changes
+func (h *HostGroups) Watch(interval time.Duration) {
+	watchPath(h.Path, interval, func() {
+		if err := h.load(); err != nil {
+			log.Errorf("Keeping previous host groups: %v", err)
+		}
+	})
+}
+
+// group returns the name of the host group of the host that sent r, an
+// empty name means the host is unrestricted
+func (h *HostGroups) group(r *http.Request) (string, HostGroup, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	token := r.Header.Get("X-Host-Token")
+	if token == "" {
+		token = r.URL.Query().Get("host_token")
+	}
+	if token != "" {
+		for name, group := range h.groups {
+			for _, groupToken := range group.Tokens {
+				if subtle.ConstantTimeCompare([]byte(token), []byte(groupToken)) == 1 {
+					return name, group, nil
+				}
+			}
+		}
+		return "", HostGroup{}, fmt.Errorf("unknown host token")
+	}
+	for _, clientName := range clientNames(r) {
+		for name, group := range h.groups {
+			for _, pattern := range group.Hosts {
+				if matched, _ := path.Match(pattern, clientName); matched {
+					return name, group, nil
+				}
+			}
+		}
+	}
+	name := r.URL.Query().Get("host_group")
+	if name == "" {
+		name = defaultHostGroup
+		if _, ok := h.groups[name]; !ok {
+			return "", HostGroup{}, nil
+		}
+	}
+	group, ok := h.groups[name]
+	if !ok {
+		return "", HostGroup{}, fmt.Errorf("unknown host group %s", name)
+	}
+	if len(group.Tokens) > 0 || len(group.Hosts) > 0 {
+		return "", HostGroup{}, fmt.Errorf("host group %s requires a host token or client certificate", name)
+	}
+	return name, group, nil
+}
+
+// entitled returns a function that reports whether a user may log in to
+// the host that sent r
+func (h *HostGroups) entitled(r *http.Request) (func(u User) bool, error) {
+	if h == nil {
+		return func(User) bool { return true }, nil
+	}
+	name, group, err := h.group(r)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return func(User) bool { return true }, nil
+	}
+	roles := make(map[string]bool)
+	for _, role := range group.Roles {
+		roles[role] = true
+	}
+	return func(u User) bool {
+		for _, role := range u.Roles {
+			if roles[role] {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
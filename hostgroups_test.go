@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// verifiedClientCert is the TLS state of a connection with a verified client
+// certificate for commonName and dnsNames
+func verifiedClientCert(commonName string, dnsNames ...string) *tls.ConnectionState {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}, DNSNames: dnsNames}
+	return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+}
+
+func TestHostGroups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pubkeyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "host-groups.json")
+	groups := `{
+		"prod": {"roles": ["ops"], "tokens": ["prod-token"], "hosts": ["*.prod.example.com"]},
+		"dev": {"roles": ["ops", "engineering"]},
+		"default": {"roles": ["engineering"]}
+	}`
+	if err := ioutil.WriteFile(path, []byte(groups), 0600); err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewHostGroups(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name       string
+		target     string
+		header     string
+		clientCert []string
+		group      string
+		err        bool
+	}{
+		{name: "token header", target: "/authorized_keys/alice", header: "prod-token", group: "prod"},
+		{name: "token parameter", target: "/authorized_keys/alice?host_token=prod-token", group: "prod"},
+		{name: "token wins over host_group", target: "/authorized_keys/alice?host_group=dev", header: "prod-token", group: "prod"},
+		{name: "unknown token", target: "/authorized_keys/alice", header: "other-token", err: true},
+		{name: "client certificate common name", target: "/authorized_keys/alice", clientCert: []string{"web1.prod.example.com"}, group: "prod"},
+		{name: "client certificate DNS name", target: "/authorized_keys/alice", clientCert: []string{"web1", "web1.prod.example.com"}, group: "prod"},
+		{name: "unmatched client certificate", target: "/authorized_keys/alice", clientCert: []string{"web1.dev.example.com"}, group: "default"},
+		{name: "host_group", target: "/authorized_keys/alice?host_group=dev", group: "dev"},
+		{name: "host_group of a group with tokens", target: "/authorized_keys/alice?host_group=prod", err: true},
+		{name: "unknown host_group", target: "/authorized_keys/alice?host_group=qa", err: true},
+		{name: "default", target: "/authorized_keys/alice", group: "default"},
+	} {
+		r := httptest.NewRequest("GET", test.target, nil)
+		if test.header != "" {
+			r.Header.Set("X-Host-Token", test.header)
+		}
+		if test.clientCert != nil {
+			r.TLS = verifiedClientCert(test.clientCert[0], test.clientCert[1:]...)
+		}
+		group, _, err := h.group(r)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got group %q", test.name, group)
+			}
+			continue
+		}
+		if err != nil || group != test.group {
+			t.Errorf("%s: got group %q, %v, want %q", test.name, group, err, test.group)
+		}
+	}
+
+	// without a default group hosts that don't identify a group are unrestricted
+	delete(h.groups, defaultHostGroup)
+	entitled, err := h.entitled(httptest.NewRequest("GET", "/authorized_keys/alice", nil))
+	if err != nil || !entitled(User{}) {
+		t.Errorf("expected an unrestricted host without a default group, got %v", err)
+	}
+	entitled, err = h.entitled(httptest.NewRequest("GET", "/authorized_keys/alice?host_group=dev", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for roles, want := range map[string]bool{"engineering": true, "ops": true, "qa": false, "": false} {
+		if got := entitled(User{Roles: []string{roles}}); got != want {
+			t.Errorf("user with role %q entitled to dev: %v, want %v", roles, got, want)
+		}
+	}
+	var none *HostGroups
+	if entitled, err := none.entitled(httptest.NewRequest("GET", "/authorized_keys/alice", nil)); err != nil || !entitled(User{}) {
+		t.Errorf("expected no host groups to leave every host unrestricted, got %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// results of key cache lookups
+const (
+	cacheFresh      = "fresh"
+	cacheRevalidate = "revalidate"
+	cacheMiss       = "miss"
+	cacheStale      = "stale"
+	cacheError      = "error"
+)
+
+var (
+	keyCache = KeyCachePolicy{
+		SoftTTL:  2 * time.Minute,
+		HardTTL:  10 * time.Minute,
+		MaxStale: 24 * time.Hour,
+	}
+	// users whose keys are being revalidated in the background
+	revalidating      = make(map[string]bool)
+	revalidatingMutex sync.Mutex
+
+	metricKeyCacheLookupsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubkeyd_key_cache_lookups_total",
+		Help: "Number of authorized_keys cache lookups, partitioned by result: fresh, revalidate, miss, stale or error.",
+	}, []string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricKeyCacheLookupsTotal)
+}
+
+// KeyCachePolicy decides how long cached keys are served. Keys younger than
+// SoftTTL are served as they are, keys younger than HardTTL are served while
+// they are refreshed in the background and older keys are fetched before
+// they are served. If fetching fails the last known keys are served until
+// they are older than MaxStale.
+type KeyCachePolicy struct {
+	SoftTTL  time.Duration
+	HardTTL  time.Duration
+	MaxStale time.Duration
+}
+
+// expiration is how long pubkeyCache keeps keys
+func (p KeyCachePolicy) expiration() time.Duration {
+	if p.MaxStale > p.HardTTL {
+		return p.MaxStale
+	}
+	return p.HardTTL
+}
+
+// cachedKeys are the authorized_keys of a user in pubkeyCache
+type cachedKeys struct {
+	Keys    string
+	Fetched time.Time
+	// when fetching newer keys last failed
+	Failed time.Time
+}
+
+// cachedAuthorizedKeys returns the authorized_keys of a user from the cache
+// or fetches and caches them, and how the lookup went. If they can't be
+// fetched the keys last fetched are returned as stale.
+func cachedAuthorizedKeys(user string, u User) (string, string, error) {
+	var entry cachedKeys
+	if cached, found := pubkeyCache.Get(user); found {
+		entry = cached.(cachedKeys)
+	} else if last, ok := state.lastKeys(user); ok {
+		entry = cachedKeys{Keys: last.Keys, Fetched: last.Fetched}
+	}
+	age := time.Since(entry.Fetched)
+
+	switch {
+	case entry.Fetched.IsZero():
+		log.Debugf("authorized_keys for user %s not found in cache", displayUser(user))
+	case age < keyCache.SoftTTL:
+		log.Debugf("authorized_keys for user %s found in cache", displayUser(user))
+		metricKeyCacheLookupsTotal.WithLabelValues(cacheFresh).Inc()
+		return entry.Keys, cacheFresh, nil
+	case age < keyCache.HardTTL:
+		log.Debugf("authorized_keys for user %s found in cache, revalidating", displayUser(user))
+		metricKeyCacheLookupsTotal.WithLabelValues(cacheRevalidate).Inc()
+		go revalidateAuthorizedKeys(user, u)
+		return entry.Keys, cacheRevalidate, nil
+	case age < keyCache.MaxStale && time.Since(entry.Failed) < keyCache.SoftTTL:
+		// don't hammer an upstream that just failed
+		log.Debugf("authorized_keys for user %s expired, serving stale keys until retry", displayUser(user))
+		metricKeyCacheLookupsTotal.WithLabelValues(cacheStale).Inc()
+		return entry.Keys, cacheStale, nil
+	default:
+		log.Debugf("authorized_keys for user %s expired", displayUser(user))
+	}
+
+	authorizedKeys, err := fetchAndCacheAuthorizedKeys(user, u)
+	if err == nil {
+		metricKeyCacheLookupsTotal.WithLabelValues(cacheMiss).Inc()
+		return authorizedKeys, cacheMiss, nil
+	}
+	if entry.Fetched.IsZero() || age >= keyCache.MaxStale {
+		metricKeyCacheLookupsTotal.WithLabelValues(cacheError).Inc()
+		return "", cacheError, err
+	}
+	log.Errorf("Serving authorized_keys of user %s fetched at %s: %v", displayUser(user), entry.Fetched.Format(time.RFC3339), err)
+	metricKeyCacheLookupsTotal.WithLabelValues(cacheStale).Inc()
+	entry.Failed = time.Now()
+	pubkeyCache.Set(user, entry, keyCache.expiration()-age)
+	return entry.Keys, cacheStale, nil
+}
+
+// freshAuthorizedKeys returns the keys of a user if they were fetched within
+// SoftTTL and fetches them otherwise. Unlike cachedAuthorizedKeys it never
+// serves older keys, not even when fetching fails.
+func freshAuthorizedKeys(user string, u User) (string, error) {
+	if cached, found := pubkeyCache.Get(user); found {
+		if entry := cached.(cachedKeys); time.Since(entry.Fetched) < keyCache.SoftTTL {
+			return entry.Keys, nil
+		}
+	}
+	return fetchAndCacheAuthorizedKeys(user, u)
+}
+
+// fetchAndCacheAuthorizedKeys fetches the keys of a user and records them
+// in the cache, the fingerprint index, the key change notifier and the state
+func fetchAndCacheAuthorizedKeys(user string, u User) (string, error) {
+	authorizedKeys, err := fetchAuthorizedKeys(u)
+	if err != nil {
+		return "", err
+	}
+	pubkeyCache.Set(user, cachedKeys{Keys: authorizedKeys, Fetched: time.Now()}, keyCache.expiration())
+	fingerprintIndex.update(user, u, authorizedKeys)
+	keyChanges.observe(user, u, authorizedKeys)
+	state.setKeys(user, authorizedKeys)
+	return authorizedKeys, nil
+}
+
+// revalidateAuthorizedKeys refreshes the cached keys of a user unless that
+// is already happening
+func revalidateAuthorizedKeys(user string, u User) {
+	revalidatingMutex.Lock()
+	if revalidating[user] {
+		revalidatingMutex.Unlock()
+		return
+	}
+	revalidating[user] = true
+	revalidatingMutex.Unlock()
+	defer func() {
+		revalidatingMutex.Lock()
+		delete(revalidating, user)
+		revalidatingMutex.Unlock()
+	}()
+
+	if _, err := fetchAndCacheAuthorizedKeys(user, u); err != nil {
+		log.Errorf("Failed to revalidate authorized_keys of user %s: %v", displayUser(user), err)
+	}
+}
+
+// purgeAuthorizedKeys forgets the keys of a user so that the next request
+// fetches them and never falls back to the old ones
+func purgeAuthorizedKeys(user string) {
+	pubkeyCache.Delete(user)
+	state.forgetKeys(user)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// cacheKeysFetchedAt caches keys for user as if they were fetched at fetched
+func cacheKeysFetchedAt(user string, keys string, fetched time.Time) {
+	pubkeyCache.Set(user, cachedKeys{Keys: keys, Fetched: fetched}, keyCache.expiration())
+}
+
+func TestKeyCachePolicy(t *testing.T) {
+	defer func(policy KeyCachePolicy) { keyCache = policy }(keyCache)
+	keyCache = KeyCachePolicy{SoftTTL: time.Minute, HardTTL: 10 * time.Minute, MaxStale: time.Hour}
+	source := &fakeKeySource{keys: map[string]string{"alice": testGithubKey + "\n"}}
+	keySources["fake"] = source
+	defer delete(keySources, "fake")
+	pubkeyCache = cache.New(time.Minute, time.Minute)
+	alice := User{Accounts: map[string]string{"fake": "alice"}}
+	old := testOtherKey + "\n"
+
+	for _, test := range []struct {
+		name    string
+		age     time.Duration
+		err     error
+		result  string
+		keys    string
+		fetches int
+	}{
+		{"miss", -1, nil, cacheMiss, testGithubKey + "\n", 1},
+		{"fresh", 30 * time.Second, nil, cacheFresh, old, 0},
+		{"revalidate", 5 * time.Minute, nil, cacheRevalidate, old, 1},
+		{"expired", 20 * time.Minute, nil, cacheMiss, testGithubKey + "\n", 1},
+		{"stale", 20 * time.Minute, errors.New("unreachable"), cacheStale, old, 1},
+		{"too stale", 2 * time.Hour, errors.New("unreachable"), cacheError, "", 1},
+	} {
+		pubkeyCache.Flush()
+		if test.age >= 0 {
+			cacheKeysFetchedAt("alice", old, time.Now().Add(-test.age))
+		}
+		source.mutex.Lock()
+		source.err, source.calls = test.err, 0
+		source.mutex.Unlock()
+
+		keys, result, err := cachedAuthorizedKeys("alice", alice)
+		if (err != nil) != (test.err != nil && test.result == cacheError) || result != test.result || keys != test.keys {
+			t.Errorf("%s: got %q, %s, %v, want %q, %s", test.name, keys, result, err, test.keys, test.result)
+		}
+		// revalidation happens in the background
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			source.mutex.Lock()
+			calls := source.calls
+			source.mutex.Unlock()
+			revalidatingMutex.Lock()
+			busy := revalidating["alice"]
+			revalidatingMutex.Unlock()
+			if calls >= test.fetches && !busy {
+				break
+			}
+		}
+		source.mutex.Lock()
+		if source.calls != test.fetches {
+			t.Errorf("%s: fetched %d times, want %d", test.name, source.calls, test.fetches)
+		}
+		source.mutex.Unlock()
+	}
+
+	// after a failed fetch the stale keys are served without fetching again
+	// until SoftTTL passed
+	source.mutex.Lock()
+	source.calls = 0
+	source.mutex.Unlock()
+	pubkeyCache.Flush()
+	cacheKeysFetchedAt("alice", old, time.Now().Add(-20*time.Minute))
+	for i := 0; i < 2; i++ {
+		if keys, result, _ := cachedAuthorizedKeys("alice", alice); result != cacheStale || keys != old {
+			t.Errorf("got %q, %s, want the stale keys", keys, result)
+		}
+	}
+	if source.calls != 1 {
+		t.Errorf("fetched %d times after a failure, want 1", source.calls)
+	}
+}
+
+func TestKeyCacheAccountChange(t *testing.T) {
+	source := &fakeKeySource{keys: map[string]string{"alice": testGithubKey + "\n", "alice2": testOtherKey + "\n"}}
+	keySources["fake"] = source
+	defer delete(keySources, "fake")
+	pubkeyCache = cache.New(time.Minute, time.Minute)
+	state = NewState("")
+	defer func() { state = nil }()
+	fingerprintIndex = NewFingerprintIndex()
+
+	users = map[string]User{
+		"alice": {Accounts: map[string]string{"fake": "alice"}, Roles: []string{"ops"}},
+		"bob":   {Accounts: map[string]string{"fake": "bob"}},
+	}
+	for user, u := range users {
+		cacheKeysFetchedAt(user, testGithubKey+"\n", time.Now())
+		state.setKeys(user, testGithubKey+"\n")
+		fingerprintIndex.update(user, u, testGithubKey+"\n")
+	}
+
+	// a new role keeps the keys, a new account drops them
+	setUsers("", map[string]User{
+		"alice": {Accounts: map[string]string{"fake": "alice"}, Roles: []string{"ops", "dev"}},
+		"bob":   {Accounts: map[string]string{"fake": "bob2"}},
+	})
+	if _, found := pubkeyCache.Get("alice"); !found {
+		t.Error("a role change purged the cached keys")
+	}
+	if _, found := pubkeyCache.Get("bob"); found {
+		t.Error("an account change kept the cached keys")
+	}
+	if _, ok := state.lastKeys("bob"); ok {
+		t.Error("an account change kept the persisted keys")
+	}
+	if entries := fingerprintIndex.lookup(sha256Fingerprint(t, testGithubKey)); len(entries) != 1 || entries[0].User != "alice" {
+		t.Errorf("got fingerprint entries %+v after the account change of bob", entries)
+	}
+	// the keys of the old account are not served while the new one fails
+	if keys, result, err := cachedAuthorizedKeys("bob", users["bob"]); err == nil {
+		t.Errorf("got %q, %s for the unknown new account", keys, result)
+	}
+
+	setUsers("", map[string]User{"bob": {Accounts: map[string]string{"fake": "alice2"}}})
+	if _, found := pubkeyCache.Get("alice"); found {
+		t.Error("removing a user kept the cached keys")
+	}
+	if keys, _, err := cachedAuthorizedKeys("bob", users["bob"]); err != nil || keys != testOtherKey+"\n" {
+		t.Errorf("got %q, %v for the new account", keys, err)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	keyChangeEvent = "keys_changed"
+	// webhook payload formats
+	webhookFormatJSON  = "json"
+	webhookFormatSlack = "slack"
+	// header with the hex HMAC-SHA256 of the payload with the webhook secret
+	webhookSignatureHeader = "X-Pubkeyd-Webhook-Signature"
+	webhookTimeout         = 10 * time.Second
+	// events waiting for delivery per webhook, further events are dropped
+	webhookQueueSize = 1000
+	// delay before the first retry, doubled for each further retry
+	webhookRetryDelay = time.Second
+)
+
+var (
+	metricKeyChangesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "pubkeyd_key_changes_total",
+		Help: "Number of detected changes of the key set of a user.",
+	})
+	metricWebhookDeliveriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubkeyd_webhook_deliveries_total",
+		Help: "Number of webhook deliveries, partitioned by webhook and result: delivered, failed or dropped.",
+	}, []string{"webhook", "result"},
+	)
+	metricWebhookRetriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubkeyd_webhook_retries_total",
+		Help: "Number of retried webhook deliveries, partitioned by webhook.",
+	}, []string{"webhook"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricKeyChangesTotal)
+	prometheus.MustRegister(metricWebhookDeliveriesTotal)
+	prometheus.MustRegister(metricWebhookRetriesTotal)
+}
+
+// ChangedKey is a key that was added to or removed from a user
+type ChangedKey struct {
+	Fingerprint string `json:"fingerprint"`
+	Type        string `json:"type"`
+	Comment     string `json:"comment,omitempty"`
+}
+
+// KeyChangeEvent is sent to the webhooks when the keys of a user change
+type KeyChangeEvent struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	// tenant the user belongs to, empty for the main identity provider
+	Tenant     string       `json:"tenant,omitempty"`
+	User       string       `json:"user"`
+	GithubName string       `json:"github,omitempty"`
+	Added      []ChangedKey `json:"added,omitempty"`
+	Removed    []ChangedKey `json:"removed,omitempty"`
+}
+
+// Webhook is a receiver of key change and other events
+type Webhook struct {
+	URL string `json:"url"`
+	// json for the event itself, slack for a Slack message
+	Format string `json:"format,omitempty"`
+	// signs the payload in the X-Pubkeyd-Webhook-Signature header if set
+	Secret string `json:"secret,omitempty"`
+
+	queue chan webhookEvent
+}
+
+// webhookEvent is an event webhooks are notified of, it is posted as JSON
+type webhookEvent interface {
+	// subject names the event in logs
+	subject() string
+	// text describes the event for humans
+	text() string
+}
+
+// KeyChangeNotifier remembers the fingerprints of the keys of every user
+// and notifies webhooks when they change between fetches, and of other
+// events that need attention. The webhooks are read from a JSON file:
+//
+//	{
+//	  "security": {"url": "https://siem.example.com/pubkeyd", "secret": "..."},
+//	  "slack": {"url": "https://hooks.slack.com/services/...", "format": "slack"}
+//	}
+//
+// Each webhook receives the events in order, failed deliveries are retried
+// with exponential backoff.
+type KeyChangeNotifier struct {
+	Webhooks map[string]*Webhook
+	Retries  int
+	Client   *http.Client
+
+	mutex sync.Mutex
+	// keys by fingerprint by user
+	keys map[string]map[string]ChangedKey
+}
+
+// NewKeyChangeNotifier loads the webhooks from path and starts delivering
+// events to them
+func NewKeyChangeNotifier(path string, retries int) (*KeyChangeNotifier, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %v", path, err)
+	}
+	var webhooks map[string]*Webhook
+	if err := json.Unmarshal(data, &webhooks); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %v", path, err)
+	}
+	for name, webhook := range webhooks {
+		if u, err := url.Parse(webhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("Webhook %s in %s has invalid url %q", name, path, webhook.URL)
+		}
+		switch webhook.Format {
+		case "":
+			webhook.Format = webhookFormatJSON
+		case webhookFormatJSON, webhookFormatSlack:
+		default:
+			return nil, fmt.Errorf("Webhook %s in %s has unknown format %s", name, path, webhook.Format)
+		}
+	}
+	n := &KeyChangeNotifier{
+		Webhooks: webhooks,
+		Retries:  retries,
+		Client:   &http.Client{Timeout: webhookTimeout},
+		keys:     make(map[string]map[string]ChangedKey),
+	}
+	for name, webhook := range webhooks {
+		webhook.queue = make(chan webhookEvent, webhookQueueSize)
+		go n.run(name, webhook)
+	}
+	log.Infof("Loaded %d webhooks", len(webhooks))
+	return n, nil
+}
+
+// parseChangedKeys returns the keys in authorizedKeys by fingerprint
+func parseChangedKeys(authorizedKeys string) map[string]ChangedKey {
+	keys := make(map[string]ChangedKey)
+	rest := []byte(authorizedKeys)
+	for len(rest) > 0 {
+		key, comment, _, next, err := ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			break
+		}
+		rest = next
+		fingerprint := ssh.FingerprintSHA256(key)
+		keys[fingerprint] = ChangedKey{Fingerprint: fingerprint, Type: key.Type(), Comment: comment}
+	}
+	return keys
+}
+
+// diffKeys returns the keys in b but not in a, sorted by fingerprint
+func diffKeys(a, b map[string]ChangedKey) []ChangedKey {
+	var diff []ChangedKey
+	for fingerprint, key := range b {
+		if _, ok := a[fingerprint]; !ok {
+			diff = append(diff, key)
+		}
+	}
+	sort.Slice(diff, func(i, j int) bool { return diff[i].Fingerprint < diff[j].Fingerprint })
+	return diff
+}
+
+// seed remembers the keys of user without notifying about them
+func (n *KeyChangeNotifier) seed(user string, authorizedKeys string) {
+	if n == nil {
+		return
+	}
+	keys := parseChangedKeys(authorizedKeys)
+	n.mutex.Lock()
+	n.keys[user] = keys
+	n.mutex.Unlock()
+}
+
+// observe compares freshly fetched keys of user with the ones fetched
+// before and notifies the webhooks if they differ. The first keys seen of
+// a user are only remembered.
+func (n *KeyChangeNotifier) observe(user string, u User, authorizedKeys string) {
+	if n == nil {
+		return
+	}
+	keys := parseChangedKeys(authorizedKeys)
+	n.mutex.Lock()
+	previous, known := n.keys[user]
+	n.keys[user] = keys
+	n.mutex.Unlock()
+	if !known {
+		return
+	}
+	tenant, name := splitUser(user)
+	event := KeyChangeEvent{
+		Event:      keyChangeEvent,
+		Time:       time.Now().UTC(),
+		Tenant:     tenant,
+		User:       name,
+		GithubName: u.GithubName,
+		Added:      diffKeys(previous, keys),
+		Removed:    diffKeys(keys, previous),
+	}
+	if len(event.Added) == 0 && len(event.Removed) == 0 {
+		return
+	}
+	log.Warningf("Keys of user %s changed, %d added and %d removed", displayUser(user), len(event.Added), len(event.Removed))
+	metricKeyChangesTotal.Inc()
+	n.notify(event)
+}
+
+// notify queues event for delivery to all webhooks
+func (n *KeyChangeNotifier) notify(event webhookEvent) {
+	if n == nil {
+		return
+	}
+	for name, webhook := range n.Webhooks {
+		select {
+		case webhook.queue <- event:
+		default:
+			log.Errorf("Dropping %s for webhook %s, too many pending events", event.subject(), name)
+			metricWebhookDeliveriesTotal.WithLabelValues(name, "dropped").Inc()
+		}
+	}
+}
+
+// run delivers the events queued for webhook
+func (n *KeyChangeNotifier) run(name string, webhook *Webhook) {
+	for event := range webhook.queue {
+		payload, err := webhook.payload(event)
+		if err != nil {
+			log.Errorf("Failed to encode %s for webhook %s: %v", event.subject(), name, err)
+			metricWebhookDeliveriesTotal.WithLabelValues(name, "failed").Inc()
+			continue
+		}
+		delay := webhookRetryDelay
+		for attempt := 0; ; attempt++ {
+			retry, err := n.deliver(webhook, payload)
+			if err == nil {
+				log.Infof("Delivered %s to webhook %s", event.subject(), name)
+				metricWebhookDeliveriesTotal.WithLabelValues(name, "delivered").Inc()
+				break
+			}
+			if !retry || attempt >= n.Retries {
+				log.Errorf("Failed to deliver %s to webhook %s: %v", event.subject(), name, err)
+				metricWebhookDeliveriesTotal.WithLabelValues(name, "failed").Inc()
+				break
+			}
+			log.Warningf("Retrying %s for webhook %s in %s: %v", event.subject(), name, delay, err)
+			metricWebhookRetriesTotal.WithLabelValues(name).Inc()
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+// deliver posts payload to webhook, on failure it reports whether trying
+// again may succeed
+func (n *KeyChangeNotifier) deliver(webhook *Webhook, payload []byte) (bool, error) {
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if webhook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(webhook.Secret))
+		mac.Write(payload)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook returned %s", resp.Status)
+	default:
+		return false, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+}
+
+// payload encodes event in the format of the webhook
+func (w *Webhook) payload(event webhookEvent) ([]byte, error) {
+	if w.Format == webhookFormatSlack {
+		return json.Marshal(map[string]string{"text": event.text()})
+	}
+	return json.Marshal(event)
+}
+
+func (e KeyChangeEvent) subject() string {
+	return "key change of user " + e.User + tenantLabel(e.Tenant)
+}
+
+func (e KeyChangeEvent) text() string {
+	lines := []string{fmt.Sprintf("SSH keys of user %s%s changed", e.User, tenantLabel(e.Tenant))}
+	if e.GithubName != "" {
+		lines[0] = fmt.Sprintf("SSH keys of user %s%s (github %s) changed", e.User, tenantLabel(e.Tenant), e.GithubName)
+	}
+	for _, key := range e.Added {
+		lines = append(lines, fmt.Sprintf("added %s %s %s", key.Type, key.Fingerprint, key.Comment))
+	}
+	for _, key := range e.Removed {
+		lines = append(lines, fmt.Sprintf("removed %s %s %s", key.Type, key.Fingerprint, key.Comment))
+	}
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+	return strings.Join(lines, "\n")
+}
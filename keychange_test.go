@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testOtherKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHx2Ac5pU7N5Yc0eQyGDGNBv2W6ZrP8M6Ld0r0jDWrQp laptop"
+
+type webhookDelivery struct {
+	path      string
+	body      []byte
+	signature string
+}
+
+func TestKeyChangeWebhooks(t *testing.T) {
+	deliveries := make(chan webhookDelivery, 10)
+	var mutex sync.Mutex
+	attempts := make(map[string]int)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mutex.Lock()
+		attempts[r.URL.Path]++
+		attempt := attempts[r.URL.Path]
+		mutex.Unlock()
+		if r.URL.Path == "/siem" && attempt == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		deliveries <- webhookDelivery{r.URL.Path, body, r.Header.Get(webhookSignatureHeader)}
+	}))
+	defer receiver.Close()
+
+	dir, err := ioutil.TempDir("", "pubkeyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "webhooks.json")
+	webhooks := fmt.Sprintf(`{
+		"security": {"url": "%s/siem", "secret": "s3cret"},
+		"chat": {"url": "%s/slack", "format": "slack"}
+	}`, receiver.URL, receiver.URL)
+	if err := ioutil.WriteFile(path, []byte(webhooks), 0600); err != nil {
+		t.Fatal(err)
+	}
+	n, err := NewKeyChangeNotifier(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n.seed("alice", testGithubKey+"\n")
+	n.observe("alice", newUser("alice-gh"), testOtherKey+"\n")
+
+	received := make(map[string]webhookDelivery)
+	for len(received) < 2 {
+		select {
+		case d := <-deliveries:
+			received[d.path] = d
+		case <-time.After(10 * time.Second):
+			t.Fatalf("only received %d deliveries", len(received))
+		}
+	}
+
+	siem := received["/siem"]
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(siem.body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); siem.signature != want {
+		t.Errorf("got signature %q, want %q", siem.signature, want)
+	}
+	var event KeyChangeEvent
+	if err := json.Unmarshal(siem.body, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Event != keyChangeEvent || event.User != "alice" || event.GithubName != "alice-gh" ||
+		len(event.Added) != 1 || event.Added[0].Comment != "laptop" || len(event.Removed) != 1 {
+		t.Errorf("unexpected event %s", siem.body)
+	}
+	mutex.Lock()
+	if attempts["/siem"] != 2 {
+		t.Errorf("expected one retry after 503, got %d attempts", attempts["/siem"])
+	}
+	mutex.Unlock()
+
+	slack := received["/slack"]
+	if slack.signature != "" {
+		t.Errorf("unexpected signature %q without secret", slack.signature)
+	}
+	var message map[string]string
+	if err := json.Unmarshal(slack.body, &message); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(message["text"], "\n")
+	if len(lines) != 3 || lines[0] != "SSH keys of user alice (github alice-gh) changed" ||
+		!strings.HasPrefix(lines[1], "added ssh-ed25519 SHA256:") || !strings.HasSuffix(lines[1], " laptop") ||
+		!strings.HasPrefix(lines[2], "removed ssh-ed25519 SHA256:") {
+		t.Errorf("unexpected Slack message %q", message["text"])
+	}
+}
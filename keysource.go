@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fatz/ghpubkey-go/ghpubkey"
+	"golang.org/x/crypto/ssh"
+)
+
+const keySourceTimeout = 30 * time.Second
+
+var (
+	// key sources by name, the name is used as account prefix (gitlab:alice)
+	// and as attribute prefix (gitlabname)
+	keySources = map[string]KeySource{
+		"github": &GithubKeySource{},
+	}
+	accountNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+)
+
+// KeySource fetches the public keys of an account from a code hosting service
+type KeySource interface {
+	// Keys returns the public keys of account in authorized_keys format
+	Keys(account string) (string, error)
+}
+
+// GithubKeySource fetches keys from github.com or a GitHub Enterprise Server
+type GithubKeySource struct {
+	// web URL of the GitHub host, defaults to https://github.com
+	URL string
+	// optional access token, when set keys are fetched through the API
+	Token  string
+	Client *http.Client
+}
+
+// GithubHost is the configuration of a GitHub host in the -github-hosts file
+type GithubHost struct {
+	URL string `json:"url"`
+	// PEM file of CAs to trust instead of the system roots
+	CA    string `json:"ca,omitempty"`
+	Token string `json:"token,omitempty"`
+}
+
+// Keys returns the public keys of a github user
+func (s *GithubKeySource) Keys(account string) (string, error) {
+	if s.Token == "" {
+		g := ghpubkey.NewGHPubKey()
+		if s.Client != nil {
+			g.Client = s.Client
+		}
+		if s.URL != "" {
+			g.BaseUrl = s.URL
+		}
+		return g.RequestKeysForUser(account)
+	}
+
+	if !ghpubkey.GHUsernameValid(account) {
+		return "", fmt.Errorf("Invalid account name %s", account)
+	}
+	apiURL := "https://api.github.com"
+	if s.URL != "" && s.URL != ghpubkey.GithubURL {
+		apiURL = s.URL + "/api/v3"
+	}
+	data, err := httpGet(s.Client, fmt.Sprintf("%s/users/%s/keys", apiURL, account), bearer(s.Token))
+	if err != nil {
+		return "", err
+	}
+	var keys []struct {
+		Key string `json:"key"`
+	}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return "", fmt.Errorf("Failed to parse keys of %s: %v", account, err)
+	}
+	authorizedKeys := ""
+	for _, k := range keys {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k.Key))
+		if err != nil {
+			return "", fmt.Errorf("Failed to parse keys of %s: %v", account, err)
+		}
+		authorizedKeys += string(ssh.MarshalAuthorizedKey(key))
+	}
+	return authorizedKeys, nil
+}
+
+// loadGithubHosts registers a key source for every host in a JSON file like
+//
+//	{
+//	  "ghe": {"url": "https://ghe.example.com", "ca": "/etc/ssl/ghe-ca.pem", "token": "..."}
+//	}
+//
+// Users then select a host with a github name like ghe:alice.
+func loadGithubHosts(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %v", path, err)
+	}
+	var hosts map[string]GithubHost
+	if err := json.Unmarshal(data, &hosts); err != nil {
+		return fmt.Errorf("Failed to parse %s: %v", path, err)
+	}
+	for name, host := range hosts {
+		if host.URL == "" {
+			return fmt.Errorf("GitHub host %s has no url", name)
+		}
+		client := &http.Client{Timeout: keySourceTimeout}
+		if host.CA != "" {
+			pem, err := ioutil.ReadFile(host.CA)
+			if err != nil {
+				return fmt.Errorf("Failed to read CA bundle of GitHub host %s: %v", name, err)
+			}
+			roots := x509.NewCertPool()
+			if !roots.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("No certificates found in CA bundle of GitHub host %s", name)
+			}
+			client.Transport = &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			}
+		}
+		log.Infof("Fetching keys of %s: accounts from %s", name, host.URL)
+		keySources[name] = &GithubKeySource{
+			URL:    strings.TrimSuffix(host.URL, "/"),
+			Token:  host.Token,
+			Client: client,
+		}
+	}
+	return nil
+}
+
+// KeysFileSource fetches keys from services that publish them at
+// /{user}.keys, like GitLab and Gitea
+type KeysFileSource struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+// Keys returns the public keys of account
+func (s *KeysFileSource) Keys(account string) (string, error) {
+	if !accountNameRegex.MatchString(account) {
+		return "", fmt.Errorf("Invalid account name %s", account)
+	}
+	data, err := httpGet(s.Client, fmt.Sprintf("%s/%s.keys", s.BaseURL, url.PathEscape(account)), "")
+	if err != nil {
+		return "", err
+	}
+	keys, err := ghpubkey.ParseAuthorizedKeys(data)
+	if err != nil {
+		return "", fmt.Errorf("Failed to parse keys of %s: %v", account, err)
+	}
+	return keys.GenAuthFIle(), nil
+}
+
+// BitbucketKeySource fetches keys from the Bitbucket Cloud API
+type BitbucketKeySource struct {
+	BaseURL string
+	// optional access token, or app password as username:app-password
+	// which is sent with basic auth
+	Token  string
+	Client *http.Client
+}
+
+// authorization returns the Authorization header value of the token
+func (s *BitbucketKeySource) authorization() string {
+	if strings.Contains(s.Token, ":") {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(s.Token))
+	}
+	return bearer(s.Token)
+}
+
+// Keys returns the public keys of a Bitbucket user
+func (s *BitbucketKeySource) Keys(account string) (string, error) {
+	if !accountNameRegex.MatchString(account) {
+		return "", fmt.Errorf("Invalid account name %s", account)
+	}
+	authorizedKeys := ""
+	next := fmt.Sprintf("%s/2.0/users/%s/ssh-keys", s.BaseURL, url.PathEscape(account))
+	for next != "" {
+		data, err := httpGet(s.Client, next, s.authorization())
+		if err != nil {
+			return "", err
+		}
+		var page struct {
+			Values []struct {
+				Key string `json:"key"`
+			} `json:"values"`
+			Next string `json:"next"`
+		}
+		if err := json.Unmarshal(data, &page); err != nil {
+			return "", fmt.Errorf("Failed to parse keys of %s: %v", account, err)
+		}
+		for _, value := range page.Values {
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(value.Key))
+			if err != nil {
+				return "", fmt.Errorf("Failed to parse keys of %s: %v", account, err)
+			}
+			authorizedKeys += string(ssh.MarshalAuthorizedKey(key))
+		}
+		next = page.Next
+	}
+	return authorizedKeys, nil
+}
+
+// bearer returns the Authorization header value of token, if any
+func bearer(token string) string {
+	if token == "" {
+		return ""
+	}
+	return "Bearer " + token
+}
+
+// httpGet returns the body of rawurl, requested with the Authorization
+// header authorization if it isn't empty
+func httpGet(client *http.Client, rawurl string, authorization string) ([]byte, error) {
+	if client == nil {
+		client = &http.Client{Timeout: keySourceTimeout}
+	}
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", rawurl, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+type account struct {
+	source string
+	name   string
+}
+
+// accounts returns all key source accounts of the user, github first
+func (u User) accounts() []account {
+	var accounts []account
+	if u.GithubName != "" {
+		accounts = append(accounts, account{"github", u.GithubName})
+	}
+	var sources []string
+	for source := range u.Accounts {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		accounts = append(accounts, account{source, u.Accounts[source]})
+	}
+	return accounts
+}
+
+// sameKeys reports whether u and other are served the same keys
+func (u User) sameKeys(other User) bool {
+	return reflect.DeepEqual(u.accounts(), other.accounts()) && reflect.DeepEqual(u.Keys, other.Keys)
+}
+
+// fetchAuthorizedKeys returns the keys of all of a users accounts followed by
+// the users inline keys
+func fetchAuthorizedKeys(u User) (string, error) {
+	authorizedKeys := ""
+	for _, a := range u.accounts() {
+		source, ok := keySources[a.source]
+		if !ok {
+			return "", fmt.Errorf("Unknown key source %s", a.source)
+		}
+		keys, err := accountFetches.do(a, func() (string, error) { return source.Keys(a.name) })
+		if err != nil {
+			return "", fmt.Errorf("Failed to get keys of %s account %s: %v", a.source, a.name, err)
+		}
+		authorizedKeys += keys
+	}
+	for _, key := range u.Keys {
+		authorizedKeys += key + "\n"
+	}
+	return authorizedKeys, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testGithubKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"
+
+// fakeKeySource serves keys by account after delay and counts the fetches
+// and how many of them ran at once
+type fakeKeySource struct {
+	mutex       sync.Mutex
+	keys        map[string]string
+	err         error
+	delay       time.Duration
+	calls       int
+	inFlight    int
+	maxInFlight int
+}
+
+func (s *fakeKeySource) Keys(account string) (string, error) {
+	s.mutex.Lock()
+	s.calls++
+	s.inFlight++
+	if s.inFlight > s.maxInFlight {
+		s.maxInFlight = s.inFlight
+	}
+	s.mutex.Unlock()
+	time.Sleep(s.delay)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.inFlight--
+	if s.err != nil {
+		return "", s.err
+	}
+	keys, ok := s.keys[account]
+	if !ok {
+		return "", fmt.Errorf("404 Not Found")
+	}
+	return keys, nil
+}
+
+// writeGithubHosts writes a -github-hosts file and returns its path
+func writeGithubHosts(t *testing.T, dir string, hosts map[string]GithubHost) string {
+	data, err := json.Marshal(hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "github-hosts.json")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGithubEnterpriseHost(t *testing.T) {
+	ghe := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer ghe-token" {
+			http.Error(w, "Bad credentials", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/api/v3/users/alice/keys" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"id": 1, "key": "` + testGithubKey + `"}]`))
+	}))
+	defer ghe.Close()
+
+	dir, err := ioutil.TempDir("", "pubkeyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := filepath.Join(dir, "ghe-ca.pem")
+	if err := ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ghe.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path := writeGithubHosts(t, dir, map[string]GithubHost{
+		"ghe":        {URL: ghe.URL + "/", CA: ca, Token: "ghe-token"},
+		"untrusted":  {URL: ghe.URL, Token: "ghe-token"},
+		"wrongtoken": {URL: ghe.URL, CA: ca, Token: "other-token"},
+	})
+	if err := loadGithubHosts(path); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		delete(keySources, "ghe")
+		delete(keySources, "untrusted")
+		delete(keySources, "wrongtoken")
+	}()
+
+	u := newUser("ghe:alice")
+	if u.GithubName != "" || u.Accounts["ghe"] != "alice" {
+		t.Fatalf("ghe:alice selected %+v", u)
+	}
+	keys, err := fetchAuthorizedKeys(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys != testGithubKey+"\n" {
+		t.Errorf("got keys %q", keys)
+	}
+
+	if _, err := fetchAuthorizedKeys(newUser("ghe:bob")); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected 404 for unknown user, got %v", err)
+	}
+	if _, err := fetchAuthorizedKeys(newUser("untrusted:alice")); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("expected certificate error without the CA bundle, got %v", err)
+	}
+	if _, err := fetchAuthorizedKeys(newUser("wrongtoken:alice")); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected 401 with the wrong token, got %v", err)
+	}
+	if u := newUser("nohost:alice"); u.GithubName != "nohost:alice" {
+		t.Errorf("unknown host prefix selected %+v", u)
+	}
+}
+
+func TestGithubHostsInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pubkeyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := filepath.Join(dir, "empty.pem")
+	if err := ioutil.WriteFile(ca, []byte("no certificates here\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []GithubHost{{}, {URL: "https://ghe.example.com", CA: ca}} {
+		path := writeGithubHosts(t, dir, map[string]GithubHost{"broken": host})
+		if err := loadGithubHosts(path); err == nil {
+			t.Errorf("loadGithubHosts accepted %+v", host)
+		}
+		delete(keySources, "broken")
+	}
+}
+
+func TestKeysFileSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/alice.keys" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(testGithubKey + "\n" + testOtherKey + "\n"))
+	}))
+	defer server.Close()
+
+	source := &KeysFileSource{BaseURL: server.URL}
+	keys, err := source.Keys("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(keys, testGithubKey) || !strings.Contains(keys, strings.Fields(testOtherKey)[1]) {
+		t.Errorf("got keys %q", keys)
+	}
+	if _, err := source.Keys("bob"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected 404 for unknown user, got %v", err)
+	}
+	if _, err := source.Keys("../alice"); err == nil {
+		t.Error("accepted an invalid account name")
+	}
+}
+
+func TestBitbucketKeySource(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); r.Header.Get("Authorization") != "Bearer token" && !(ok && user == "alice" && password == "app-password") {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var page map[string]interface{}
+		switch r.URL.Path + "?" + r.URL.RawQuery {
+		case "/2.0/users/alice/ssh-keys?":
+			page = map[string]interface{}{
+				"values": []map[string]string{{"key": testGithubKey}},
+				"next":   server.URL + "/2.0/users/alice/ssh-keys?page=2",
+			}
+		case "/2.0/users/alice/ssh-keys?page=2":
+			page = map[string]interface{}{"values": []map[string]string{{"key": testOtherKey}}}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(page)
+	}))
+	defer server.Close()
+
+	want := testGithubKey + "\n" + strings.Join(strings.Fields(testOtherKey)[:2], " ") + "\n"
+	for _, token := range []string{"token", "alice:app-password"} {
+		keys, err := (&BitbucketKeySource{BaseURL: server.URL, Token: token}).Keys("alice")
+		if err != nil {
+			t.Fatalf("token %s: %v", token, err)
+		}
+		if keys != want {
+			t.Errorf("token %s: got keys %q, want %q", token, keys, want)
+		}
+	}
+	if _, err := (&BitbucketKeySource{BaseURL: server.URL, Token: "wrong"}).Keys("alice"); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected 401 with the wrong token, got %v", err)
+	}
+}
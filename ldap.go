@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Just enough of LDAPv3 (RFC 4511) to do a simple bind followed by a
+// paged subtree search. Requests and responses are BER encoded by hand
+// so that we don't have to vendor a full LDAP client library.
+const (
+	// per request, a paged search may take many requests
+	ldapTimeout         = 30 * time.Second
+	ldapPageSize        = 500
+	ldapPagedResultsOID = "1.2.840.113556.1.4.319"
+	// ACCOUNTDISABLE bit of the Active Directory userAccountControl attribute
+	adAccountDisable = 0x2
+
+	berBool        = 0x01
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+
+	ldapBindRequest           = 0x60
+	ldapBindResponse          = 0x61
+	ldapUnbindRequest         = 0x42
+	ldapSearchRequest         = 0x63
+	ldapSearchResultEntry     = 0x64
+	ldapSearchResultDone      = 0x65
+	ldapSearchResultReference = 0x73
+	ldapAuthSimple            = 0x80
+	ldapFilterAnd             = 0xa0
+	ldapFilterEquality        = 0xa3
+	ldapFilterPresent         = 0x87
+	ldapControls              = 0xa0
+
+	ldapResultSuccess  = 0
+	ldapScopeSubtree   = 2
+	ldapDerefNever     = 0
+	ldapProtocolLevel3 = 3
+)
+
+// LDAPProvider reads users from an LDAP directory like OpenLDAP or Active Directory
+type LDAPProvider struct {
+	// ldap:// or ldaps:// URL of the directory server
+	URL string
+	// CAs to verify ldaps:// servers with, the system roots if nil
+	RootCAs      *x509.CertPool
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// only entries of this objectClass are considered users
+	ObjectClass string
+	// attribute holding the local username, e.g. uid or sAMAccountName
+	UserAttr string
+	// attribute holding the github name
+	GithubAttr string
+	// optional attribute that marks an account as disabled when set to
+	// anything but "false", e.g. nsAccountLock or pwdAccountLockedTime
+	DisabledAttr string
+}
+
+// Users returns all enabled LDAP users that have a github name set
+func (p *LDAPProvider) Users() (map[string]User, error) {
+	log.Info("Updating users from LDAP")
+	githubUsers := make(map[string]User)
+	conn, err := dialLDAP(p.URL, p.RootCAs)
+	if err != nil {
+		return githubUsers, fmt.Errorf("Failed to connect to LDAP server: %v", err)
+	}
+	defer conn.Close()
+
+	if p.BindDN != "" {
+		if err := conn.bind(p.BindDN, p.BindPassword); err != nil {
+			return githubUsers, fmt.Errorf("Failed to bind to LDAP server: %v", err)
+		}
+	}
+
+	attributes := []string{p.UserAttr, p.GithubAttr, "userAccountControl", "memberOf"}
+	if p.DisabledAttr != "" {
+		attributes = append(attributes, p.DisabledAttr)
+	}
+	entries, err := conn.search(p.BaseDN, p.ObjectClass, p.GithubAttr, attributes)
+	if err != nil {
+		return githubUsers, fmt.Errorf("Failed to get users: %v", err)
+	}
+	for _, entry := range entries {
+		username := entry.get(p.UserAttr)
+		githubName := entry.get(p.GithubAttr)
+		if username == "" || githubName == "" {
+			continue
+		}
+		if p.disabled(entry) {
+			log.Debugf("Skipping disabled user %s", username)
+			continue
+		}
+		log.Debugf("Setting github name for user %s to %s\n", username, githubName)
+		u := newUser(githubName)
+		u.Roles = entry.groups()
+		githubUsers[username] = u
+	}
+	return githubUsers, nil
+}
+
+func (p *LDAPProvider) disabled(entry ldapEntry) bool {
+	if uac := entry.get("userAccountControl"); uac != "" {
+		if flags, err := strconv.Atoi(uac); err == nil && flags&adAccountDisable != 0 {
+			return true
+		}
+	}
+	if p.DisabledAttr != "" {
+		if value := entry.get(p.DisabledAttr); value != "" && !strings.EqualFold(value, "false") {
+			return true
+		}
+	}
+	return false
+}
+
+type ldapEntry struct {
+	dn         string
+	attributes map[string][]string
+}
+
+// get returns the first value of an attribute, attribute names are case insensitive
+func (e ldapEntry) get(attribute string) string {
+	if values := e.attributes[strings.ToLower(attribute)]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// groups returns the common names of the groups listed in memberOf
+func (e ldapEntry) groups() []string {
+	var groups []string
+	for _, dn := range e.attributes["memberof"] {
+		rdn := strings.SplitN(dn, ",", 2)[0]
+		if i := strings.Index(rdn, "="); i != -1 {
+			groups = append(groups, rdn[i+1:])
+		}
+	}
+	return groups
+}
+
+type ldapConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	messageID int
+}
+
+// loadLDAPCA reads the CAs to verify ldaps:// servers with from path
+func loadLDAPCA(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read LDAP CA bundle: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in LDAP CA bundle %s", path)
+	}
+	return roots, nil
+}
+
+func dialLDAP(rawurl string, rootCAs *x509.CertPool) (*ldapConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	dialer := &net.Dialer{Timeout: ldapTimeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "389")
+		}
+		conn, err = dialer.Dial("tcp", host)
+	case "ldaps":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "636")
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname(), RootCAs: rootCAs})
+	default:
+		return nil, fmt.Errorf("unsupported LDAP URL scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ldapConn{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+func (c *ldapConn) Close() error {
+	c.send(berEncode(ldapUnbindRequest), nil)
+	return c.conn.Close()
+}
+
+func (c *ldapConn) bind(dn, password string) error {
+	if err := c.send(berEncode(ldapBindRequest,
+		berInt(berInteger, ldapProtocolLevel3),
+		berString(berOctetString, dn),
+		berString(ldapAuthSimple, password),
+	), nil); err != nil {
+		return err
+	}
+	op, _, err := c.receive()
+	if err != nil {
+		return err
+	}
+	if op.tag != ldapBindResponse {
+		return fmt.Errorf("unexpected response 0x%x to bind request", op.tag)
+	}
+	return ldapResultError(op)
+}
+
+// search returns all entries below baseDN of the given objectClass that have presentAttr set
+func (c *ldapConn) search(baseDN, objectClass, presentAttr string, attributes []string) ([]ldapEntry, error) {
+	filter := berEncode(ldapFilterAnd,
+		berEncode(ldapFilterEquality, berString(berOctetString, "objectClass"), berString(berOctetString, objectClass)),
+		berString(ldapFilterPresent, presentAttr),
+	)
+	var attributeList [][]byte
+	for _, attribute := range attributes {
+		attributeList = append(attributeList, berString(berOctetString, attribute))
+	}
+
+	var entries []ldapEntry
+	cookie := ""
+	for {
+		request := berEncode(ldapSearchRequest,
+			berString(berOctetString, baseDN),
+			berInt(berEnumerated, ldapScopeSubtree),
+			berInt(berEnumerated, ldapDerefNever),
+			berInt(berInteger, 0),
+			berInt(berInteger, 0),
+			berEncode(berBool, []byte{0x00}),
+			filter,
+			berEncode(berSequence, attributeList...),
+		)
+		paging := berEncode(ldapControls, berEncode(berSequence,
+			berString(berOctetString, ldapPagedResultsOID),
+			berEncode(berOctetString, berEncode(berSequence,
+				berInt(berInteger, ldapPageSize),
+				berString(berOctetString, cookie),
+			)),
+		))
+		if err := c.send(request, paging); err != nil {
+			return nil, err
+		}
+
+		cookie = ""
+		for done := false; !done; {
+			op, controls, err := c.receive()
+			if err != nil {
+				return nil, err
+			}
+			switch op.tag {
+			case ldapSearchResultEntry:
+				entry, err := parseLDAPEntry(op)
+				if err != nil {
+					return nil, err
+				}
+				entries = append(entries, entry)
+			case ldapSearchResultReference:
+				// referrals to other servers are not followed
+			case ldapSearchResultDone:
+				if err := ldapResultError(op); err != nil {
+					return nil, err
+				}
+				cookie = pagedResultsCookie(controls)
+				done = true
+			default:
+				return nil, fmt.Errorf("unexpected response 0x%x to search request", op.tag)
+			}
+		}
+		if cookie == "" {
+			return entries, nil
+		}
+	}
+}
+
+func (c *ldapConn) send(op []byte, controls []byte) error {
+	c.messageID++
+	c.conn.SetWriteDeadline(time.Now().Add(ldapTimeout))
+	_, err := c.conn.Write(berEncode(berSequence, berInt(berInteger, c.messageID), op, controls))
+	return err
+}
+
+// receive reads the next LDAPMessage and returns its protocolOp and controls
+func (c *ldapConn) receive() (berElement, []berElement, error) {
+	var op berElement
+	c.conn.SetReadDeadline(time.Now().Add(ldapTimeout))
+	message, err := berRead(c.reader)
+	if err != nil {
+		return op, nil, err
+	}
+	elements, err := berChildren(message.content)
+	if err != nil {
+		return op, nil, err
+	}
+	if len(elements) < 2 {
+		return op, nil, fmt.Errorf("malformed LDAP message")
+	}
+	op = elements[1]
+	var controls []berElement
+	if len(elements) > 2 && elements[2].tag == ldapControls {
+		controls, err = berChildren(elements[2].content)
+	}
+	return op, controls, err
+}
+
+func ldapResultError(op berElement) error {
+	elements, err := berChildren(op.content)
+	if err != nil {
+		return err
+	}
+	if len(elements) < 3 {
+		return fmt.Errorf("malformed LDAP result")
+	}
+	if code := berReadInt(elements[0].content); code != ldapResultSuccess {
+		return fmt.Errorf("LDAP result code %d: %s", code, elements[2].content)
+	}
+	return nil
+}
+
+func parseLDAPEntry(op berElement) (ldapEntry, error) {
+	entry := ldapEntry{attributes: make(map[string][]string)}
+	elements, err := berChildren(op.content)
+	if err != nil {
+		return entry, err
+	}
+	if len(elements) < 2 {
+		return entry, fmt.Errorf("malformed LDAP search result entry")
+	}
+	entry.dn = string(elements[0].content)
+	attributes, err := berChildren(elements[1].content)
+	if err != nil {
+		return entry, err
+	}
+	for _, attribute := range attributes {
+		parts, err := berChildren(attribute.content)
+		if err != nil || len(parts) < 2 {
+			return entry, fmt.Errorf("malformed attribute in entry %s", entry.dn)
+		}
+		values, err := berChildren(parts[1].content)
+		if err != nil {
+			return entry, err
+		}
+		name := strings.ToLower(string(parts[0].content))
+		for _, value := range values {
+			entry.attributes[name] = append(entry.attributes[name], string(value.content))
+		}
+	}
+	return entry, nil
+}
+
+// pagedResultsCookie returns the cookie of a simple paged results control (RFC 2696)
+func pagedResultsCookie(controls []berElement) string {
+	for _, control := range controls {
+		parts, err := berChildren(control.content)
+		if err != nil || len(parts) < 2 || string(parts[0].content) != ldapPagedResultsOID {
+			continue
+		}
+		value, _, err := berParse(parts[len(parts)-1].content)
+		if err != nil {
+			return ""
+		}
+		fields, err := berChildren(value.content)
+		if err != nil || len(fields) < 2 {
+			return ""
+		}
+		return string(fields[1].content)
+	}
+	return ""
+}
+
+type berElement struct {
+	tag     byte
+	content []byte
+}
+
+func berEncode(tag byte, content ...[]byte) []byte {
+	var body []byte
+	for _, c := range content {
+		body = append(body, c...)
+	}
+	return append(append([]byte{tag}, berLength(len(body))...), body...)
+}
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+func berInt(tag byte, v int) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(v)}, b...)
+		if v >= -128 && v < 128 {
+			break
+		}
+		v >>= 8
+	}
+	return berEncode(tag, b)
+}
+
+func berString(tag byte, s string) []byte {
+	return berEncode(tag, []byte(s))
+}
+
+func berReadInt(content []byte) int {
+	v := 0
+	for i, b := range content {
+		if i == 0 && b&0x80 != 0 {
+			v = -1
+		}
+		v = v<<8 | int(b)
+	}
+	return v
+}
+
+// berParse splits the first element off data
+func berParse(data []byte) (berElement, []byte, error) {
+	if len(data) < 2 {
+		return berElement{}, nil, fmt.Errorf("truncated BER element")
+	}
+	length, offset := int(data[1]), 2
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 || len(data) < 2+n {
+			return berElement{}, nil, fmt.Errorf("invalid BER length")
+		}
+		length = 0
+		for _, b := range data[2 : 2+n] {
+			length = length<<8 | int(b)
+		}
+		offset += n
+	}
+	if len(data) < offset+length {
+		return berElement{}, nil, fmt.Errorf("truncated BER element")
+	}
+	return berElement{tag: data[0], content: data[offset : offset+length]}, data[offset+length:], nil
+}
+
+func berChildren(data []byte) ([]berElement, error) {
+	var elements []berElement
+	for len(data) > 0 {
+		element, rest, err := berParse(data)
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, element)
+		data = rest
+	}
+	return elements, nil
+}
+
+// berRead reads a single element from a stream
+func berRead(r *bufio.Reader) (berElement, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return berElement{}, err
+	}
+	length := int(header[1])
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 {
+			return berElement{}, fmt.Errorf("invalid BER length")
+		}
+		lengthBytes := make([]byte, n)
+		if _, err := io.ReadFull(r, lengthBytes); err != nil {
+			return berElement{}, err
+		}
+		length = 0
+		for _, b := range lengthBytes {
+			length = length<<8 | int(b)
+		}
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return berElement{}, err
+	}
+	return berElement{tag: header[0], content: content}, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBERIntRoundTrip(t *testing.T) {
+	for _, v := range []int{0, 1, 127, 128, 255, 256, 500, 65535, 1 << 24, -1, -128, -129, -65536} {
+		element, rest, err := berParse(berInt(berInteger, v))
+		if err != nil {
+			t.Fatalf("berParse of %d: %v", v, err)
+		}
+		if len(rest) != 0 || element.tag != berInteger {
+			t.Errorf("berInt(%d) parsed to tag 0x%x with %d trailing bytes", v, element.tag, len(rest))
+		}
+		if got := berReadInt(element.content); got != v {
+			t.Errorf("berInt(%d) read back as %d", v, got)
+		}
+	}
+}
+
+func TestBERLengthRoundTrip(t *testing.T) {
+	for _, n := range []int{0, 1, 127, 128, 255, 256, 70000} {
+		content := bytes.Repeat([]byte{'x'}, n)
+		encoded := berEncode(berOctetString, content)
+		element, rest, err := berParse(encoded)
+		if err != nil {
+			t.Fatalf("berParse of %d bytes: %v", n, err)
+		}
+		if len(rest) != 0 || !bytes.Equal(element.content, content) {
+			t.Errorf("%d bytes didn't round trip", n)
+		}
+		streamed, err := berRead(bufio.NewReader(bytes.NewReader(encoded)))
+		if err != nil {
+			t.Fatalf("berRead of %d bytes: %v", n, err)
+		}
+		if !bytes.Equal(streamed.content, content) {
+			t.Errorf("%d bytes didn't round trip through berRead", n)
+		}
+	}
+}
+
+func TestBERNested(t *testing.T) {
+	encoded := berEncode(berSequence,
+		berString(berOctetString, "uid"),
+		berEncode(berSequence, berInt(berInteger, 3), berString(berOctetString, "alice")),
+	)
+	element, _, err := berParse(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	children, err := berChildren(element.content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(children) != 2 || string(children[0].content) != "uid" || children[1].tag != berSequence {
+		t.Fatalf("unexpected children %v", children)
+	}
+	inner, err := berChildren(children[1].content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inner) != 2 || berReadInt(inner[0].content) != 3 || string(inner[1].content) != "alice" {
+		t.Errorf("unexpected inner children %v", inner)
+	}
+}
+
+func TestBERTruncated(t *testing.T) {
+	encoded := berString(berOctetString, "alice")
+	for i := 0; i < len(encoded); i++ {
+		if _, _, err := berParse(encoded[:i]); err == nil {
+			t.Errorf("berParse accepted %d of %d bytes", i, len(encoded))
+		}
+	}
+	if _, _, err := berParse([]byte{berOctetString, 0x85, 1, 2, 3, 4, 5}); err == nil {
+		t.Error("berParse accepted a 5 byte length")
+	}
+}
+
+// ldapTestEntry encodes a SearchResultEntry
+func ldapTestEntry(dn string, attributes map[string][]string) []byte {
+	var list [][]byte
+	for name, values := range attributes {
+		var encoded [][]byte
+		for _, value := range values {
+			encoded = append(encoded, berString(berOctetString, value))
+		}
+		list = append(list, berEncode(berSequence, berString(berOctetString, name), berEncode(0x31, encoded...)))
+	}
+	return berEncode(ldapSearchResultEntry, berString(berOctetString, dn), berEncode(berSequence, list...))
+}
+
+func ldapTestResult(tag byte, code int, message string) []byte {
+	return berEncode(tag, berInt(berEnumerated, code), berString(berOctetString, ""), berString(berOctetString, message))
+}
+
+func ldapTestPaging(cookie string) []byte {
+	return berEncode(ldapControls, berEncode(berSequence,
+		berString(berOctetString, ldapPagedResultsOID),
+		berEncode(berOctetString, berEncode(berSequence, berInt(berInteger, 0), berString(berOctetString, cookie))),
+	))
+}
+
+// serveLDAP answers binds and serves pages of search result entries by
+// paged results cookie, the first page has the empty cookie
+func serveLDAP(t *testing.T, listener net.Listener, password string, pages map[string][][]byte, next map[string]string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		message, err := berRead(reader)
+		if err != nil {
+			return
+		}
+		elements, err := berChildren(message.content)
+		if err != nil || len(elements) < 2 {
+			t.Errorf("malformed request: %v", err)
+			return
+		}
+		id := berReadInt(elements[0].content)
+		reply := func(op []byte, controls []byte) {
+			conn.Write(berEncode(berSequence, berInt(berInteger, id), op, controls))
+		}
+		switch elements[1].tag {
+		case ldapBindRequest:
+			fields, _ := berChildren(elements[1].content)
+			if len(fields) == 3 && string(fields[2].content) == password {
+				reply(ldapTestResult(ldapBindResponse, ldapResultSuccess, ""), nil)
+			} else {
+				reply(ldapTestResult(ldapBindResponse, 49, "invalid credentials"), nil)
+			}
+		case ldapSearchRequest:
+			var controls []berElement
+			if len(elements) > 2 {
+				controls, _ = berChildren(elements[2].content)
+			}
+			cookie := pagedResultsCookie(controls)
+			for _, entry := range pages[cookie] {
+				reply(entry, nil)
+			}
+			reply(ldapTestResult(ldapSearchResultDone, ldapResultSuccess, ""), ldapTestPaging(next[cookie]))
+		case ldapUnbindRequest:
+			return
+		}
+	}
+}
+
+func TestLDAPProviderUsers(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	pages := map[string][][]byte{
+		"": {
+			ldapTestEntry("uid=alice,ou=people,dc=example,dc=com", map[string][]string{
+				"uid": {"alice"}, "githubName": {"alice-gh"},
+				"memberOf": {"cn=ops,ou=groups,dc=example,dc=com", "cn=dev,ou=groups,dc=example,dc=com"},
+			}),
+			ldapTestEntry("uid=bob,ou=people,dc=example,dc=com", map[string][]string{
+				"uid": {"bob"}, "githubName": {"bob-gh"}, "userAccountControl": {"514"},
+			}),
+		},
+		"page2": {
+			ldapTestEntry("uid=carol,ou=people,dc=example,dc=com", map[string][]string{
+				"uid": {"carol"}, "githubName": {"carol-gh"}, "nsAccountLock": {"false"},
+			}),
+			ldapTestEntry("uid=dave,ou=people,dc=example,dc=com", map[string][]string{
+				"uid": {"dave"}, "githubName": {"dave-gh"}, "nsAccountLock": {"true"},
+			}),
+		},
+	}
+	next := map[string]string{"": "page2"}
+	go serveLDAP(t, listener, "secret", pages, next)
+
+	p := &LDAPProvider{
+		URL:          "ldap://" + listener.Addr().String(),
+		BindDN:       "cn=pubkeyd,dc=example,dc=com",
+		BindPassword: "secret",
+		BaseDN:       "dc=example,dc=com",
+		ObjectClass:  "person",
+		UserAttr:     "uid",
+		GithubAttr:   "githubname",
+		DisabledAttr: "nsAccountLock",
+	}
+	githubUsers, err := p.Users()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]User{
+		"alice": newUser("alice-gh"),
+		"carol": newUser("carol-gh"),
+	}
+	alice := want["alice"]
+	alice.Roles = []string{"ops", "dev"}
+	want["alice"] = alice
+	if !reflect.DeepEqual(githubUsers, want) {
+		t.Errorf("got users %v, want %v", githubUsers, want)
+	}
+}
+
+func TestLDAPProviderBindFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go serveLDAP(t, listener, "secret", nil, nil)
+
+	p := &LDAPProvider{URL: "ldap://" + listener.Addr().String(), BindDN: "cn=pubkeyd", BindPassword: "wrong"}
+	_, err = p.Users()
+	if err == nil || !strings.Contains(err.Error(), "invalid credentials") {
+		t.Errorf("expected bind failure, got %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	oktaPageSize = 200
+	oktaTimeout  = 30 * time.Second
+)
+
+var oktaNextLink = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// OktaProvider reads users and a github name profile property from Okta
+type OktaProvider struct {
+	// Okta org URL, e.g. https://example.okta.com
+	URL string
+	// API token used in the SSWS authorization header
+	Token string
+	// profile property holding the local username
+	UserAttr string
+	// profile property holding the github name
+	GithubAttr string
+	Keys       KeysAttribute
+	Client     *http.Client
+
+	mutex sync.Mutex
+	// the last known groups by id, kept for groups whose members can't be read
+	groups map[string]oktaGroupMembers
+}
+
+type oktaUser struct {
+	ID      string                 `json:"id"`
+	Status  string                 `json:"status"`
+	Profile map[string]interface{} `json:"profile"`
+}
+
+type oktaGroup struct {
+	ID      string `json:"id"`
+	Profile struct {
+		Name string `json:"name"`
+	} `json:"profile"`
+}
+
+// oktaGroupMembers are the name and the member user ids of a group
+type oktaGroupMembers struct {
+	name    string
+	members []string
+}
+
+// Users returns all ACTIVE Okta users that have a github name set, with the
+// names of their groups as roles
+func (p *OktaProvider) Users() (map[string]User, error) {
+	log.Info("Updating users from Okta")
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	githubUsers := make(map[string]User)
+	client := p.Client
+	if client == nil {
+		client = &http.Client{Timeout: oktaTimeout}
+	}
+	roles := p.roles(client)
+	query := url.Values{}
+	query.Set("limit", fmt.Sprintf("%d", oktaPageSize))
+	query.Set("filter", `status eq "ACTIVE"`)
+	next := p.URL + "/api/v1/users?" + query.Encode()
+	for next != "" {
+		var oktaUsers []oktaUser
+		var err error
+		next, err = p.getPage(client, next, &oktaUsers)
+		if err != nil {
+			return githubUsers, fmt.Errorf("Failed to get users: %v", err)
+		}
+		for _, user := range oktaUsers {
+			profile := func(name string) string {
+				value, _ := user.Profile[name].(string)
+				return value
+			}
+			username := profile(p.UserAttr)
+			u := newUser(profile(p.GithubAttr))
+			u.addAccounts(profile)
+			p.Keys.apply(username, &u, profile)
+			if username != "" && !u.empty() && user.Status == "ACTIVE" {
+				u.Roles = roles[user.ID]
+				log.Debugf("Setting github name for user %s to %s\n", username, u.GithubName)
+				githubUsers[username] = u
+			}
+		}
+	}
+	return githubUsers, nil
+}
+
+// roles returns the names of the groups of every user by user id. The
+// groups and their members are read once per refresh, groups whose members
+// can't be read keep their last known members. If the groups can't be
+// listed all groups keep their last known members.
+func (p *OktaProvider) roles(client *http.Client) map[string][]string {
+	groups := make(map[string]oktaGroupMembers)
+	next := p.URL + "/api/v1/groups?limit=" + fmt.Sprintf("%d", oktaPageSize)
+	for next != "" {
+		var page []oktaGroup
+		var err error
+		if next, err = p.getPage(client, next, &page); err != nil {
+			log.Errorf("Failed to get Okta groups, using the last known groups: %v", err)
+			groups = p.groups
+			break
+		}
+		for _, group := range page {
+			members, err := p.members(client, group.ID)
+			if err != nil {
+				log.Errorf("Failed to get members of Okta group %s, using the last known members: %v", group.Profile.Name, err)
+				members = p.groups[group.ID].members
+			}
+			groups[group.ID] = oktaGroupMembers{name: group.Profile.Name, members: members}
+		}
+	}
+	p.groups = groups
+	roles := make(map[string][]string)
+	for _, group := range groups {
+		for _, id := range group.members {
+			roles[id] = append(roles[id], group.name)
+		}
+	}
+	for _, names := range roles {
+		sort.Strings(names)
+	}
+	return roles
+}
+
+// members returns the user ids of the members of the Okta group with id
+func (p *OktaProvider) members(client *http.Client, id string) ([]string, error) {
+	var ids []string
+	next := p.URL + "/api/v1/groups/" + url.PathEscape(id) + "/users?limit=" + fmt.Sprintf("%d", oktaPageSize)
+	for next != "" {
+		var members []oktaUser
+		var err error
+		if next, err = p.getPage(client, next, &members); err != nil {
+			return nil, err
+		}
+		for _, member := range members {
+			ids = append(ids, member.ID)
+		}
+	}
+	return ids, nil
+}
+
+// getPage decodes one page of results into v and returns the URL of the next page
+func (p *OktaProvider) getPage(client *http.Client, pageURL string, v interface{}) (string, error) {
+	req, err := http.NewRequest("GET", pageURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "SSWS "+p.Token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %s", pageURL, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return "", err
+	}
+	for _, link := range resp.Header["Link"] {
+		if m := oktaNextLink.FindStringSubmatch(link); m != nil {
+			return m[1], nil
+		}
+	}
+	return "", nil
+}
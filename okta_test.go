@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestOktaProviderUsers(t *testing.T) {
+	var mutex sync.Mutex
+	failOps := false
+	requests := make(map[string]int)
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "SSWS token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mutex.Lock()
+		requests[r.URL.Path]++
+		fail := failOps
+		mutex.Unlock()
+		var body interface{}
+		switch r.URL.Path + "?" + r.URL.Query().Get("after") {
+		case "/api/v1/users?":
+			if r.URL.Query().Get("filter") != `status eq "ACTIVE"` {
+				t.Errorf("unexpected filter %q", r.URL.Query().Get("filter"))
+			}
+			w.Header().Set("Link", `<`+server.URL+`/api/v1/users?after=u2>; rel="next"`)
+			body = []map[string]interface{}{
+				{"id": "u1", "status": "ACTIVE", "profile": map[string]string{"login": "alice", "githubname": "alice-gh"}},
+				{"id": "u2", "status": "ACTIVE", "profile": map[string]string{"login": "bob"}},
+			}
+		case "/api/v1/users?u2":
+			body = []map[string]interface{}{
+				{"id": "u3", "status": "ACTIVE", "profile": map[string]string{"login": "carol", "githubname": "carol-gh"}},
+			}
+		case "/api/v1/groups?":
+			body = []map[string]interface{}{
+				{"id": "g1", "profile": map[string]string{"name": "ops"}},
+				{"id": "g2", "profile": map[string]string{"name": "dev"}},
+			}
+		case "/api/v1/groups/g1/users?":
+			if fail {
+				http.Error(w, "rate limited", http.StatusTooManyRequests)
+				return
+			}
+			body = []map[string]string{{"id": "u1"}, {"id": "u3"}}
+		case "/api/v1/groups/g2/users?":
+			body = []map[string]string{{"id": "u1"}}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+	defer server.Close()
+
+	p := &OktaProvider{URL: server.URL, Token: "token", UserAttr: "login", GithubAttr: "githubname"}
+	alice := newUser("alice-gh")
+	alice.Roles = []string{"dev", "ops"}
+	carol := newUser("carol-gh")
+	carol.Roles = []string{"ops"}
+	want := map[string]User{"alice": alice, "carol": carol}
+	for _, fail := range []bool{false, true} {
+		mutex.Lock()
+		failOps = fail
+		mutex.Unlock()
+		got, err := p.Users()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got users %v with failing group members %v, want %v", got, fail, want)
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if requests["/api/v1/groups"] != 2 || requests["/api/v1/groups/g2/users"] != 2 {
+		t.Errorf("expected the groups to be read once per refresh, got %v", requests)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oswell/onelogin-go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	oneLoginEventsPath     = "api/1/events"
+	oneLoginEventTypesPath = "api/1/events/types"
+)
+
+var (
+	metricOneLoginEventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubkeyd_onelogin_events_total",
+		Help: "Number of users changed by OneLogin events, partitioned by action: set or delete.",
+	}, []string{"action"},
+	)
+	metricOneLoginEventPollFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "pubkeyd_onelogin_event_poll_failures_total",
+		Help: "Number of failed polls of the OneLogin events API.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(metricOneLoginEventsTotal)
+	prometheus.MustRegister(metricOneLoginEventPollFailuresTotal)
+}
+
+// OneLoginEvent is an entry of the OneLogin events API
+type OneLoginEvent struct {
+	ID          int       `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	EventTypeID int       `json:"event_type_id"`
+	UserID      int       `json:"user_id"`
+}
+
+type oneLoginEventsResponse struct {
+	Status     onelogin.ResponseStatus     `json:"status"`
+	Pagination onelogin.ResponsePagination `json:"pagination"`
+	Data       []OneLoginEvent             `json:"data"`
+}
+
+type oneLoginEventTypesResponse struct {
+	Status onelogin.ResponseStatus `json:"status"`
+	Data   []struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	} `json:"data"`
+}
+
+// OneLoginEventCursor is the position in the OneLogin event stream
+type OneLoginEventCursor struct {
+	// creation time of the last processed events
+	Since time.Time `json:"since"`
+	// ids of the processed events created at Since, the API returns them
+	// again when asked for the events since then
+	Seen []int `json:"seen,omitempty"`
+}
+
+// OneLoginEventSync tails the OneLogin events API and updates or removes
+// the users that events of the given types are about right away, instead
+// of waiting for the next full refresh. The cursor is persisted so that
+// events that happen while pubkeyd is down are applied after a restart.
+type OneLoginEventSync struct {
+	Provider   *OneLoginProvider
+	CursorPath string
+	// names or ids of the event types that update the user
+	TypeNames []string
+
+	types  map[int]bool
+	cursor OneLoginEventCursor
+}
+
+// NewOneLoginEventSync continues from the cursor stored at cursorPath, or
+// starts with the events from now on
+func NewOneLoginEventSync(provider *OneLoginProvider, cursorPath string, typeNames []string) (*OneLoginEventSync, error) {
+	s := &OneLoginEventSync{
+		Provider:   provider,
+		CursorPath: cursorPath,
+		TypeNames:  typeNames,
+		cursor:     OneLoginEventCursor{Since: time.Now().UTC()},
+	}
+	if cursorPath == "" {
+		return s, nil
+	}
+	data, err := ioutil.ReadFile(cursorPath)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %v", cursorPath, err)
+	}
+	if err := json.Unmarshal(data, &s.cursor); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %v", cursorPath, err)
+	}
+	log.Infof("Continuing OneLogin events from %s", s.cursor.Since.Format(time.RFC3339))
+	return s, nil
+}
+
+// resolveTypes looks up the ids of the event type names
+func (s *OneLoginEventSync) resolveTypes() error {
+	ids := make(map[string]int)
+	types := make(map[int]bool)
+	for _, name := range s.TypeNames {
+		if id, err := strconv.Atoi(name); err == nil {
+			types[id] = true
+			continue
+		}
+		if len(ids) == 0 {
+			var resp oneLoginEventTypesResponse
+			s.Provider.mutex.Lock()
+			err := s.Provider.get(oneLoginEventTypesPath, nil, &resp, &resp.Status)
+			s.Provider.mutex.Unlock()
+			if err != nil {
+				return fmt.Errorf("Failed to get OneLogin event types: %v", err)
+			}
+			for _, eventType := range resp.Data {
+				ids[eventType.Name] = eventType.ID
+			}
+		}
+		if id, ok := ids[name]; ok {
+			types[id] = true
+		} else {
+			log.Errorf("Ignoring unknown OneLogin event type %s", name)
+		}
+	}
+	if len(types) == 0 {
+		return fmt.Errorf("None of the OneLogin event types %s exist", strings.Join(s.TypeNames, ","))
+	}
+	s.types = types
+	return nil
+}
+
+// events returns the events since the cursor, oldest first
+func (s *OneLoginEventSync) events() ([]OneLoginEvent, error) {
+	params := map[string]string{"since": s.cursor.Since.Format(time.RFC3339)}
+	var events []OneLoginEvent
+	s.Provider.mutex.Lock()
+	defer s.Provider.mutex.Unlock()
+	for {
+		var resp oneLoginEventsResponse
+		if err := s.Provider.get(oneLoginEventsPath, params, &resp, &resp.Status); err != nil {
+			return nil, fmt.Errorf("Failed to get OneLogin events: %v", err)
+		}
+		events = append(events, resp.Data...)
+		if resp.Pagination.After_cursor == "" {
+			break
+		}
+		params["after_cursor"] = resp.Pagination.After_cursor
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].CreatedAt.Equal(events[j].CreatedAt) {
+			return events[i].ID < events[j].ID
+		}
+		return events[i].CreatedAt.Before(events[j].CreatedAt)
+	})
+	return events, nil
+}
+
+// poll applies the new events and advances the cursor past them
+func (s *OneLoginEventSync) poll() error {
+	events, err := s.events()
+	if err != nil {
+		return err
+	}
+	seen := make(map[int]bool)
+	for _, id := range s.cursor.Seen {
+		seen[id] = true
+	}
+	cursor := s.cursor
+	var userIDs []int
+	changed := make(map[int]bool)
+	for _, event := range events {
+		if event.CreatedAt.Before(cursor.Since) || (event.CreatedAt.Equal(s.cursor.Since) && seen[event.ID]) {
+			continue
+		}
+		if event.CreatedAt.After(cursor.Since) {
+			cursor = OneLoginEventCursor{Since: event.CreatedAt}
+		}
+		cursor.Seen = append(cursor.Seen, event.ID)
+		if s.types[event.EventTypeID] && event.UserID != 0 && !changed[event.UserID] {
+			changed[event.UserID] = true
+			userIDs = append(userIDs, event.UserID)
+		}
+	}
+	if len(cursor.Seen) == len(s.cursor.Seen) && cursor.Since.Equal(s.cursor.Since) {
+		return nil
+	}
+	// the cursor only advances once all users are updated, applying an
+	// event twice does no harm
+	for _, userID := range userIDs {
+		if err := s.apply(userID); err != nil {
+			return err
+		}
+	}
+	s.cursor = cursor
+	if s.CursorPath == "" {
+		return nil
+	}
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return fmt.Errorf("Failed to encode OneLogin event cursor: %v", err)
+	}
+	return writeFileAtomic(s.CursorPath, data)
+}
+
+// apply fetches the OneLogin user with userID and updates or removes it
+func (s *OneLoginEventSync) apply(userID int) error {
+	p := s.Provider
+	var resp onelogin.GetUserResponse
+	p.mutex.Lock()
+	err := p.get(onelogin.USER_GET_USERS, map[string]string{"id": strconv.Itoa(userID)}, &resp, &resp.Status)
+	var username string
+	var u User
+	active := false
+	switch {
+	case err != nil:
+	case len(resp.Data) > 0:
+		// keep the users of the last sync current so that incremental syncs
+		// don't bring back removed users
+		p.update(resp.Data[0])
+		username = resp.Data[0].Username
+		u, active = p.users[username]
+	default:
+		username = p.remove(userID)
+	}
+	p.mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("Failed to get OneLogin user %d: %v", userID, err)
+	}
+	if username == "" {
+		log.Debugf("Ignoring event of unknown OneLogin user %d%s", userID, tenantLabel(p.Tenant))
+		return nil
+	}
+	if !validUsername(username) {
+		log.Errorf("Ignoring event of OneLogin user %q%s, usernames can't contain NUL", username, tenantLabel(p.Tenant))
+		return nil
+	}
+	username = tenantQualified(p.Tenant, username)
+
+	// merged with the other identity providers, so that the users file
+	// keeps precedence over OneLogin
+	switch action := updateUser(p, username, u, active); action {
+	case "set":
+		log.Infof("Updated user %s after OneLogin event", displayUser(username))
+		s.countEvent(action)
+	case "delete":
+		log.Infof("Removed user %s after OneLogin event", displayUser(username))
+		s.countEvent(action)
+	}
+	return nil
+}
+
+// countEvent counts a user change, tenants have their own metrics
+func (s *OneLoginEventSync) countEvent(action string) {
+	if tenant := s.Provider.Tenant; tenant != "" {
+		metricTenantOneLoginEventsTotal.WithLabelValues(tenant, action).Inc()
+	} else {
+		metricOneLoginEventsTotal.WithLabelValues(action).Inc()
+	}
+}
+
+// countPollFailure counts a failed poll, tenants have their own metrics
+func (s *OneLoginEventSync) countPollFailure() {
+	if tenant := s.Provider.Tenant; tenant != "" {
+		metricTenantOneLoginEventPollFailuresTotal.WithLabelValues(tenant).Inc()
+	} else {
+		metricOneLoginEventPollFailuresTotal.Inc()
+	}
+}
+
+// run polls the events every interval
+func (s *OneLoginEventSync) run(interval time.Duration) {
+	for ; ; time.Sleep(interval) {
+		if s.types == nil {
+			if err := s.resolveTypes(); err != nil {
+				log.Error(err)
+				s.countPollFailure()
+				continue
+			}
+		}
+		if err := s.poll(); err != nil {
+			log.Error(err)
+			s.countPollFailure()
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/oswell/onelogin-go"
+	"github.com/patrickmn/go-cache"
+)
+
+func TestOneLoginEventsKeepUsersFilePrecedence(t *testing.T) {
+	oneLoginUsers := map[string]onelogin.OneLoginUser{
+		"1": {Id: 1, Username: "alice", Status: 1, Custom_attributes: map[string]string{"githubname": "alice-onelogin"}},
+	}
+	server, client := fakeOneLogin(t, func(path string, query map[string]string) interface{} {
+		switch path {
+		case onelogin.ROLE_GET_ROLES:
+			return oneLoginPage([]onelogin.OneLoginRole{}, "")
+		case onelogin.USER_GET_USERS:
+			page := []onelogin.OneLoginUser{}
+			for id, user := range oneLoginUsers {
+				if query["id"] == "" || query["id"] == id {
+					page = append(page, user)
+				}
+			}
+			return oneLoginPage(page, "")
+		}
+		return nil
+	})
+	defer server.Close()
+
+	pubkeyCache = cache.New(time.Minute, time.Minute)
+	provider := &OneLoginProvider{OneLogin: client}
+	file := &staticProvider{users: map[string]User{"alice": newUser("alice-file")}}
+	idp = &LayeredProvider{Layers: []IdentityProvider{provider, file}}
+	if err := refreshOneLoginUsers(); err != nil {
+		t.Fatal(err)
+	}
+	eventSync := &OneLoginEventSync{Provider: provider}
+	want := map[string]User{"alice": newUser("alice-file")}
+
+	oneLoginUsers["1"] = onelogin.OneLoginUser{Id: 1, Username: "alice", Status: 1, Custom_attributes: map[string]string{"githubname": "alice-changed"}}
+	oneLoginUsers["2"] = onelogin.OneLoginUser{Id: 2, Username: "bob", Status: 1, Custom_attributes: map[string]string{"githubname": "bob-onelogin"}}
+	for _, id := range []int{1, 2} {
+		if err := eventSync.apply(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want["bob"] = newUser("bob-onelogin")
+	if !reflect.DeepEqual(users, want) {
+		t.Errorf("got users %v after update events, want %v", users, want)
+	}
+
+	delete(oneLoginUsers, "1")
+	delete(oneLoginUsers, "2")
+	for _, id := range []int{1, 2} {
+		if err := eventSync.apply(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	delete(want, "bob")
+	if !reflect.DeepEqual(users, want) {
+		t.Errorf("got users %v after delete events, want %v", users, want)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	metricPrefetchesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubkeyd_prefetches_total",
+		Help: "Number of keys prefetched after a users refresh, partitioned by result: ok, error or skipped.",
+	}, []string{"result"},
+	)
+	metricPrefetchLastFailures = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "pubkeyd_prefetch_last_failures",
+		Help: "Number of users whose keys couldn't be fetched in the last prefetch.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(metricPrefetchesTotal)
+	prometheus.MustRegister(metricPrefetchLastFailures)
+}
+
+// Prefetcher fetches the keys of all users after every users refresh so
+// that logins find them in the cache
+type Prefetcher struct {
+	Workers int
+	// the prefetch starts after a random delay of up to Jitter so that
+	// several pubkeyd instances don't hit the key sources at once
+	Jitter time.Duration
+
+	mutex   sync.Mutex
+	running bool
+}
+
+// start prefetches the keys of all users in the background unless a
+// prefetch is still running
+func (p *Prefetcher) start() {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.running {
+		log.Info("Previous prefetch still running, skipping prefetch")
+		return
+	}
+	p.running = true
+	refreshMutex.RLock()
+	snapshot := make(map[string]User, len(users))
+	for user, u := range users {
+		snapshot[user] = u
+	}
+	refreshMutex.RUnlock()
+	go func() {
+		p.run(snapshot)
+		p.mutex.Lock()
+		p.running = false
+		p.mutex.Unlock()
+	}()
+}
+
+func (p *Prefetcher) run(users map[string]User) {
+	if p.Jitter > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(p.Jitter))))
+	}
+	names := make([]string, 0, len(users))
+	for user := range users {
+		names = append(names, user)
+	}
+	rand.Shuffle(len(names), func(i, j int) { names[i], names[j] = names[j], names[i] })
+
+	log.Infof("Prefetching keys of %d users with %d workers", len(names), p.Workers)
+	start := time.Now()
+	var failuresMutex sync.Mutex
+	failures := 0
+	forEachUser(names, p.Workers, func(user string) {
+		if !prefetchAuthorizedKeys(user, users[user]) {
+			failuresMutex.Lock()
+			failures++
+			failuresMutex.Unlock()
+		}
+	})
+	metricPrefetchLastFailures.Set(float64(failures))
+	log.Infof("Prefetched keys of %d users in %s, %d failed", len(names), time.Since(start), failures)
+}
+
+// forEachUser calls fn for each of names with at most workers calls running
+// at once
+func forEachUser(names []string, workers int, fn func(user string)) {
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for user := range jobs {
+				fn(user)
+			}
+		}()
+	}
+	for _, user := range names {
+		jobs <- user
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// prefetchAuthorizedKeys fetches the keys of a user unless the cached ones
+// are still fresh. Failures are recorded on the cached keys so that requests
+// serve them as stale instead of retrying right away.
+func prefetchAuthorizedKeys(user string, u User) bool {
+	cached, found := pubkeyCache.Get(user)
+	if found && time.Since(cached.(cachedKeys).Fetched) < keyCache.SoftTTL {
+		metricPrefetchesTotal.WithLabelValues("skipped").Inc()
+		return true
+	}
+	if _, err := fetchAndCacheAuthorizedKeys(user, u); err != nil {
+		log.Errorf("Failed to prefetch authorized_keys of user %s: %v", displayUser(user), err)
+		metricPrefetchesTotal.WithLabelValues("error").Inc()
+		if found {
+			entry := cached.(cachedKeys)
+			entry.Failed = time.Now()
+			if expiration := keyCache.expiration() - time.Since(entry.Fetched); expiration > 0 {
+				pubkeyCache.Set(user, entry, expiration)
+			}
+		}
+		return false
+	}
+	metricPrefetchesTotal.WithLabelValues("ok").Inc()
+	return true
+}
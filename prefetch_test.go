@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+func TestPrefetcher(t *testing.T) {
+	source := &fakeKeySource{keys: make(map[string]string), delay: 20 * time.Millisecond}
+	keySources["fake"] = source
+	defer delete(keySources, "fake")
+	pubkeyCache = cache.New(time.Minute, time.Minute)
+
+	snapshot := make(map[string]User)
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("user%d", i)
+		source.keys[name] = testGithubKey + "\n"
+		snapshot[name] = User{Accounts: map[string]string{"fake": name}}
+	}
+	// fresh keys are skipped, users whose keys can't be fetched keep the
+	// stale ones and are marked as failed
+	cacheKeysFetchedAt("user0", testOtherKey+"\n", time.Now())
+	delete(source.keys, "user1")
+	cacheKeysFetchedAt("user1", testOtherKey+"\n", time.Now().Add(-time.Hour))
+
+	p := &Prefetcher{Workers: 3}
+	p.run(snapshot)
+
+	if source.calls != 19 {
+		t.Errorf("fetched %d users, want 19", source.calls)
+	}
+	if source.maxInFlight < 2 || source.maxInFlight > p.Workers {
+		t.Errorf("fetched %d users at once, want 2 to %d", source.maxInFlight, p.Workers)
+	}
+	for user := range snapshot {
+		cached, found := pubkeyCache.Get(user)
+		if !found {
+			t.Errorf("keys of %s not prefetched", user)
+			continue
+		}
+		entry := cached.(cachedKeys)
+		switch user {
+		case "user0":
+			if entry.Keys != testOtherKey+"\n" {
+				t.Errorf("fresh keys of user0 replaced by %q", entry.Keys)
+			}
+		case "user1":
+			if entry.Keys != testOtherKey+"\n" || entry.Failed.IsZero() {
+				t.Errorf("got %+v for the failed prefetch of user1", entry)
+			}
+		default:
+			if entry.Keys != testGithubKey+"\n" || time.Since(entry.Fetched) > time.Minute {
+				t.Errorf("got %+v for %s", entry, user)
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+)
+
+// PrincipalRules maps local accounts to the roles or groups whose members
+// may log in to them with a certificate. The account "*" applies to all
+// accounts:
+//
+//	{
+//	  "deploy": ["ops", "release"],
+//	  "*": ["admins"]
+//	}
+type PrincipalRules map[string][]string
+
+func loadPrincipalRules(path string) (PrincipalRules, error) {
+	rules := make(PrincipalRules)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return rules, fmt.Errorf("Failed to read %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return rules, fmt.Errorf("Failed to parse %s: %v", path, err)
+	}
+	return rules, nil
+}
+
+// principals returns the certificate principals accepted for a local
+// account: the account itself if it belongs to a known user plus every
+// user that is a member of one of the accounts roles. Users that are not
+// entitled to log in to the requesting host are left out.
+func (rules PrincipalRules) principals(account string, users map[string]User, entitled func(User) bool) []string {
+	allowed := make(map[string]bool)
+	for _, roles := range [][]string{rules[account], rules["*"]} {
+		for _, role := range roles {
+			allowed[role] = true
+		}
+	}
+	principals := make(map[string]bool)
+	// certificates are only issued to users of the main identity provider
+	if u, ok := users[account]; ok && entitled(u) && userTenant(account) == "" {
+		principals[account] = true
+	}
+	for username, u := range users {
+		if !entitled(u) || userTenant(username) != "" {
+			continue
+		}
+		for _, role := range u.Roles {
+			if allowed[role] {
+				principals[username] = true
+				break
+			}
+		}
+	}
+	var sorted []string
+	for principal := range principals {
+		sorted = append(sorted, principal)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPrincipalRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pubkeyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "principals.json")
+	if err := ioutil.WriteFile(path, []byte(`{"deploy": ["ops", "release"], "*": ["admins"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := loadPrincipalRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := map[string]User{
+		"alice": {Roles: []string{"ops"}},
+		"bob":   {Roles: []string{"engineering", "release"}},
+		"carol": {Roles: []string{"admins"}},
+		"dave":  {Roles: []string{"engineering"}},
+		"eve":   {},
+	}
+	all := func(User) bool { return true }
+	notAdmins := func(u User) bool { return !reflect.DeepEqual(u.Roles, []string{"admins"}) }
+	for _, test := range []struct {
+		account  string
+		entitled func(User) bool
+		want     []string
+	}{
+		{"deploy", all, []string{"alice", "bob", "carol"}},
+		{"deploy", notAdmins, []string{"alice", "bob"}},
+		{"dave", all, []string{"carol", "dave"}},
+		{"dave", notAdmins, []string{"dave"}},
+		{"ubuntu", all, []string{"carol"}},
+		{"ubuntu", notAdmins, nil},
+	} {
+		if got := rules.principals(test.account, users, test.entitled); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("account %s: got principals %v, want %v", test.account, got, test.want)
+		}
+	}
+
+	if got := (PrincipalRules{}).principals("eve", users, all); !reflect.DeepEqual(got, []string{"eve"}) {
+		t.Errorf("got principals %v without rules, want the account itself", got)
+	}
+	if err := ioutil.WriteFile(path, []byte(`{"deploy": "ops"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadPrincipalRules(path); err == nil {
+		t.Error("loadPrincipalRules accepted a role that is not a list")
+	}
+}
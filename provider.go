@@ -0,0 +1,641 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oswell/onelogin-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/ssh"
+)
+
+// OneLogin sync types and the changes they make
+const (
+	syncFull        = "full"
+	syncIncremental = "incremental"
+	syncAdded       = "added"
+	syncChanged     = "changed"
+	syncRemoved     = "removed"
+	// how far incremental syncs reach back before the previous sync
+	oneLoginSyncOverlap = time.Minute
+)
+
+var (
+	// keys in an attribute are separated by newlines or semicolons since
+	// most identity providers only offer single line attributes
+	keysAttributeSeparator = regexp.MustCompile(`[\r\n;]+`)
+	metricInvalidKeysTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "pubkeyd_invalid_attribute_keys_total",
+		Help: "Number of invalid public keys found in identity provider attributes.",
+	})
+	metricOneLoginSyncsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubkeyd_onelogin_syncs_total",
+		Help: "Number of successful OneLogin user syncs, partitioned by type: full or incremental.",
+	}, []string{"type"},
+	)
+	metricOneLoginSyncDelta = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pubkeyd_onelogin_sync_delta_users",
+		Help: "Number of users the last OneLogin sync of a type added, changed or removed.",
+	}, []string{"type", "change"},
+	)
+	metricOneLoginSyncChangesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubkeyd_onelogin_sync_changes_total",
+		Help: "Number of users OneLogin syncs added, changed or removed, partitioned by sync type and change.",
+	}, []string{"type", "change"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricInvalidKeysTotal)
+	prometheus.MustRegister(metricOneLoginSyncsTotal)
+	prometheus.MustRegister(metricOneLoginSyncDelta)
+	prometheus.MustRegister(metricOneLoginSyncChangesTotal)
+}
+
+// User is a local user as known to an identity provider
+type User struct {
+	// github account the users public keys are fetched from
+	GithubName string `json:"github,omitempty"`
+	// accounts on other key sources, e.g. gitlab: alice
+	Accounts map[string]string `json:"accounts,omitempty"`
+	// authorized_keys entries that are served in addition to the github keys
+	Keys []string `json:"keys,omitempty"`
+	// OneLogin roles or LDAP groups the user is a member of
+	Roles []string `json:"roles,omitempty"`
+}
+
+// newUser creates a user from a github name attribute. The value may
+// instead name an account on another key source, like gitlab:alice.
+func newUser(githubName string) User {
+	if i := strings.Index(githubName, ":"); i != -1 {
+		if _, ok := keySources[githubName[:i]]; ok {
+			return User{Accounts: map[string]string{githubName[:i]: githubName[i+1:]}}
+		}
+	}
+	return User{GithubName: githubName}
+}
+
+// addAccounts adds the accounts found in <source>name attributes like gitlabname
+func (u *User) addAccounts(attribute func(name string) string) {
+	for source := range keySources {
+		if source == "github" {
+			continue
+		}
+		if name := attribute(source + "name"); name != "" {
+			if u.Accounts == nil {
+				u.Accounts = make(map[string]string)
+			}
+			u.Accounts[source] = name
+		}
+	}
+}
+
+func (u User) empty() bool {
+	return u.GithubName == "" && len(u.Accounts) == 0 && len(u.Keys) == 0
+}
+
+// KeysAttribute reads public keys stored directly in an identity provider attribute
+type KeysAttribute struct {
+	// attribute name, empty to disable
+	Name string
+	// serve the attribute keys together with the keys of the users
+	// accounts instead of in place of them
+	Merge bool
+}
+
+// apply adds the valid keys of the attribute to u, invalid keys are logged and skipped
+func (k KeysAttribute) apply(username string, u *User, attribute func(name string) string) {
+	if k.Name == "" {
+		return
+	}
+	var keys []string
+	for _, entry := range keysAttributeSeparator.Split(attribute(k.Name), -1) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(entry))
+		if err != nil {
+			log.Errorf("Ignoring invalid key in attribute %s of user %s: %v", k.Name, username, err)
+			metricInvalidKeysTotal.Inc()
+			continue
+		}
+		// options are dropped, only the key and its comment are served
+		keys = append(keys, strings.TrimSpace(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))+" "+comment))
+	}
+	if len(keys) == 0 {
+		return
+	}
+	if !k.Merge {
+		u.GithubName = ""
+		u.Accounts = nil
+	}
+	u.Keys = append(u.Keys, keys...)
+}
+
+// IdentityProvider is a directory that knows which local users exist
+// and where their public keys come from
+type IdentityProvider interface {
+	// Users returns a map of active usernames to users
+	Users() (map[string]User, error)
+}
+
+// resyncer is implemented by identity providers whose results build on the
+// previous one, which must start over if that result was not applied
+type resyncer interface {
+	resync()
+}
+
+// OneLoginProvider reads users and their githubname custom attribute from
+// OneLogin. With a FullRefresh interval only the users updated since the
+// last sync are fetched in between full syncs, which are still needed to
+// notice deleted users.
+type OneLoginProvider struct {
+	OneLogin    *onelogin.OneLogin
+	Keys        KeysAttribute
+	FullRefresh time.Duration
+	// custom attribute holding the github name, githubname if empty
+	GithubAttr string
+	// name of the tenant the users belong to, empty for the main provider
+	Tenant string
+
+	// serializes the use of OneLogin, which caches its token unsynchronized
+	mutex sync.Mutex
+	// role names by id, OneLogin users by id and users as of the last sync
+	roleNames     map[int]string
+	oneLoginUsers map[int]onelogin.OneLoginUser
+	users         map[string]User
+	// start of the last sync and the last full sync
+	synced     time.Time
+	fullSynced time.Time
+}
+
+// Users returns all active OneLogin users that have a github name or keys set
+func (p *OneLoginProvider) Users() (map[string]User, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.users == nil || p.FullRefresh == 0 || time.Since(p.fullSynced) >= p.FullRefresh {
+		return p.getGithubUsers()
+	}
+	return p.getUpdatedGithubUsers()
+}
+
+// resync makes the next sync a full one, as the users of the last sync
+// were refused
+func (p *OneLoginProvider) resync() {
+	p.mutex.Lock()
+	p.fullSynced = time.Time{}
+	p.mutex.Unlock()
+}
+
+// get requests a OneLogin API path into resp, status must point to the
+// status of resp
+func (p *OneLoginProvider) get(path string, params map[string]string, resp interface{}, status *onelogin.ResponseStatus) error {
+	token, err := p.OneLogin.Get_Token()
+	if err != nil {
+		p.OneLogin.Token = nil
+		return err
+	}
+	client := onelogin.HttpClient{Url: p.OneLogin.GetUrl(path), Headers: onelogin.Headers("bearer:" + token.Access_token), Params: params}
+	if _, err := client.Request("GET", nil, resp); err != nil {
+		return err
+	}
+	if status.Error {
+		if status.Code == http.StatusUnauthorized {
+			// the token expired, get a new one next time
+			p.OneLogin.Token = nil
+		}
+		return fmt.Errorf("%s returned %d %s", path, status.Code, status.Message)
+	}
+	return nil
+}
+
+// getUsers returns all pages of the OneLogin users matching filter
+func (p *OneLoginProvider) getUsers(filter map[string]string) ([]onelogin.OneLoginUser, error) {
+	var oneLoginUsers []onelogin.OneLoginUser
+	for {
+		var resp onelogin.GetUserResponse
+		if err := p.get(onelogin.USER_GET_USERS, filter, &resp, &resp.Status); err != nil {
+			return nil, err
+		}
+		oneLoginUsers = append(oneLoginUsers, resp.Data...)
+		if resp.Pagination.After_cursor == "" {
+			return oneLoginUsers, nil
+		}
+		filter["after_cursor"] = resp.Pagination.After_cursor
+	}
+}
+
+// getRoles returns all pages of the OneLogin roles
+func (p *OneLoginProvider) getRoles() ([]onelogin.OneLoginRole, error) {
+	var roles []onelogin.OneLoginRole
+	params := make(map[string]string)
+	for {
+		var resp onelogin.GetRoleResponse
+		if err := p.get(onelogin.ROLE_GET_ROLES, params, &resp, &resp.Status); err != nil {
+			return nil, err
+		}
+		roles = append(roles, resp.Data...)
+		if resp.Pagination.After_cursor == "" {
+			return roles, nil
+		}
+		params["after_cursor"] = resp.Pagination.After_cursor
+	}
+}
+
+func (p *OneLoginProvider) getGithubUsers() (map[string]User, error) {
+	log.Info("Updating users from OneLogin")
+	start := time.Now()
+	filter := make(map[string]string)
+	oneLoginUsers, err := p.getUsers(filter)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get users: %v", err)
+	}
+	if _, err := p.updateRoles(); err != nil {
+		return nil, fmt.Errorf("Failed to get roles: %v", err)
+	}
+	previous := p.users
+	p.oneLoginUsers = make(map[int]onelogin.OneLoginUser)
+	p.users = make(map[string]User)
+	for _, user := range oneLoginUsers {
+		p.update(user)
+	}
+	added, changed, removed := 0, 0, 0
+	for username, u := range p.users {
+		if old, ok := previous[username]; !ok {
+			added++
+		} else if !reflect.DeepEqual(old, u) {
+			changed++
+		}
+	}
+	for username := range previous {
+		if _, ok := p.users[username]; !ok {
+			removed++
+		}
+	}
+	recordSyncDelta(p.Tenant, syncFull, added, changed, removed)
+	p.synced = start
+	p.fullSynced = start
+	return p.copyUsers(), nil
+}
+
+// getUpdatedGithubUsers merges the users updated since the last sync into
+// the users of the last sync
+func (p *OneLoginProvider) getUpdatedGithubUsers() (map[string]User, error) {
+	start := time.Now()
+	// overlap the previous sync to tolerate clock skew, merging a user twice
+	// does no harm
+	since := p.synced.Add(-oneLoginSyncOverlap).UTC().Format(time.RFC3339)
+	log.Infof("Updating users changed since %s from OneLogin", since)
+	oneLoginUsers, err := p.getUsers(map[string]string{"updated_since": since})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get updated users: %v", err)
+	}
+	// renaming a role doesn't update its members
+	rolesChanged, err := p.updateRoles()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get roles: %v", err)
+	}
+	changes := make(map[string]int)
+	if rolesChanged {
+		for _, user := range p.oneLoginUsers {
+			changes[p.update(user)]++
+		}
+	}
+	for _, user := range oneLoginUsers {
+		changes[p.update(user)]++
+	}
+	recordSyncDelta(p.Tenant, syncIncremental, changes[syncAdded], changes[syncChanged], changes[syncRemoved])
+	p.synced = start
+	return p.copyUsers(), nil
+}
+
+// updateRoles fetches the role names and reports whether they changed
+func (p *OneLoginProvider) updateRoles() (bool, error) {
+	roles, err := p.getRoles()
+	if err != nil {
+		return false, err
+	}
+	roleNames := make(map[int]string, len(roles))
+	for _, role := range roles {
+		roleNames[role.Id] = role.Name
+	}
+	changed := !reflect.DeepEqual(roleNames, p.roleNames)
+	p.roleNames = roleNames
+	return changed, nil
+}
+
+// update applies a fetched OneLogin user to the users of the last sync and
+// returns how they changed: added, changed, removed or empty
+func (p *OneLoginProvider) update(user onelogin.OneLoginUser) string {
+	if p.oneLoginUsers == nil {
+		p.oneLoginUsers = make(map[int]onelogin.OneLoginUser)
+		p.users = make(map[string]User)
+	}
+	if old, ok := p.oneLoginUsers[user.Id]; ok && old.Username != user.Username {
+		delete(p.users, old.Username)
+	}
+	p.oneLoginUsers[user.Id] = user
+	old, known := p.users[user.Username]
+	u, ok := p.user(user)
+	switch {
+	case !ok && !known:
+		return ""
+	case !ok:
+		delete(p.users, user.Username)
+		return syncRemoved
+	case !known:
+		log.Debugf("Setting github name for user %s to %s\n", user.Username, u.GithubName)
+		p.users[user.Username] = u
+		return syncAdded
+	case !reflect.DeepEqual(old, u):
+		p.users[user.Username] = u
+		return syncChanged
+	}
+	return ""
+}
+
+// remove drops the deleted OneLogin user with id from the users of the
+// last sync and returns its username
+func (p *OneLoginProvider) remove(id int) string {
+	username := p.oneLoginUsers[id].Username
+	delete(p.oneLoginUsers, id)
+	delete(p.users, username)
+	return username
+}
+
+func (p *OneLoginProvider) copyUsers() map[string]User {
+	githubUsers := make(map[string]User, len(p.users))
+	for username, u := range p.users {
+		githubUsers[username] = u
+	}
+	return githubUsers
+}
+
+// recordSyncDelta updates the metrics of the users a sync changed
+func recordSyncDelta(tenant string, syncType string, added, changed, removed int) {
+	log.Infof("OneLogin %s sync%s added %d, changed %d and removed %d users", syncType, tenantLabel(tenant), added, changed, removed)
+	// the syncs of tenants have their own metrics
+	labels := prometheus.Labels{"type": syncType}
+	syncs, delta, changes := metricOneLoginSyncsTotal, metricOneLoginSyncDelta, metricOneLoginSyncChangesTotal
+	if tenant != "" {
+		labels["tenant"] = tenant
+		syncs, delta, changes = metricTenantOneLoginSyncsTotal, metricTenantOneLoginSyncDelta, metricTenantOneLoginSyncChangesTotal
+	}
+	syncs.With(labels).Inc()
+	delta, changes = delta.MustCurryWith(labels), changes.MustCurryWith(labels)
+	delta.WithLabelValues(syncAdded).Set(float64(added))
+	delta.WithLabelValues(syncChanged).Set(float64(changed))
+	delta.WithLabelValues(syncRemoved).Set(float64(removed))
+	changes.WithLabelValues(syncAdded).Add(float64(added))
+	changes.WithLabelValues(syncChanged).Add(float64(changed))
+	changes.WithLabelValues(syncRemoved).Add(float64(removed))
+}
+
+// user converts a OneLogin user, it reports false for inactive users and
+// users without github name or keys
+func (p *OneLoginProvider) user(user onelogin.OneLoginUser) (User, bool) {
+	if user.Status != 1 {
+		return User{}, false
+	}
+	attribute := func(name string) string { return user.Custom_attributes[name] }
+	githubAttr := p.GithubAttr
+	if githubAttr == "" {
+		githubAttr = "githubname"
+	}
+	u := newUser(attribute(githubAttr))
+	u.addAccounts(attribute)
+	p.Keys.apply(user.Username, &u, attribute)
+	for _, roleID := range user.Role_id {
+		if name, ok := p.roleNames[roleID]; ok {
+			u.Roles = append(u.Roles, tenantRole(p.Tenant, name))
+		}
+	}
+	return u, !u.empty()
+}
+
+// LayeredProvider merges the users of several identity providers. Layers
+// later in the list take precedence over earlier ones. When a layer fails
+// its last successful result is used so that an unreachable upstream does
+// not remove the users of the other layers. A layer that fails before it
+// ever succeeded makes the result incomplete, which is reported as an
+// incompleteUsersError. Revoked users, like users deprovisioned through
+// SCIM, are left out of all layers until no layer returns them anymore.
+type LayeredProvider struct {
+	Layers []IdentityProvider
+	// JSON file the revoked usernames are persisted in, none if empty
+	RevokedPath string
+
+	mutex    sync.Mutex
+	lastGood map[IdentityProvider]map[string]User
+	// layers that returned users at least once
+	succeeded map[IdentityProvider]bool
+	revoked   map[string]bool
+}
+
+// incompleteUsersError is returned by LayeredProvider when a layer failed
+// without a last successful result, users are the merged users of the
+// other layers
+type incompleteUsersError struct {
+	users map[string]User
+	err   error
+}
+
+func (e *incompleteUsersError) Error() string {
+	return fmt.Sprintf("Identity provider failed before its first successful refresh: %v", e.err)
+}
+
+// Users returns the merged users of all layers
+func (p *LayeredProvider) Users() (map[string]User, error) {
+	// the layers are asked without holding the mutex, as layers that push
+	// changes resolve them with resolve while holding their own locks
+	results := make([]map[string]User, len(p.Layers))
+	errs := make([]error, len(p.Layers))
+	for i, layer := range p.Layers {
+		results[i], errs[i] = layer.Users()
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.lastGood == nil {
+		p.lastGood = make(map[IdentityProvider]map[string]User)
+		p.succeeded = make(map[IdentityProvider]bool)
+	}
+	merged := make(map[string]User)
+	failed := 0
+	var err, incomplete error
+	for i, layer := range p.Layers {
+		layerUsers, layerErr := results[i], errs[i]
+		if layerErr != nil {
+			if !p.succeeded[layer] {
+				incomplete = layerErr
+			} else {
+				log.Errorf("Using last known users of failed identity provider: %v", layerErr)
+			}
+			layerUsers = p.lastGood[layer]
+			err = layerErr
+			failed++
+		} else {
+			p.lastGood[layer] = layerUsers
+			p.succeeded[layer] = true
+		}
+		for username, user := range layerUsers {
+			merged[username] = user
+		}
+	}
+	p.applyRevoked(merged, failed == 0)
+	if failed == len(p.Layers) {
+		return merged, err
+	}
+	if incomplete != nil {
+		return merged, &incompleteUsersError{users: merged, err: incomplete}
+	}
+	return merged, nil
+}
+
+// resync passes a refused result on to the layers that build on their
+// previous one
+func (p *LayeredProvider) resync() {
+	for _, layer := range p.Layers {
+		if r, ok := layer.(resyncer); ok {
+			r.resync()
+		}
+	}
+}
+
+// resolve records a change of username in layer in between refreshes and
+// returns the user as merged from all layers, ok is false if the user is
+// gone from layer and reported false if it is gone from all layers. Changes
+// of providers that aren't a layer, like tenants, are returned as they are.
+func (p *LayeredProvider) resolve(layer IdentityProvider, username string, u User, ok bool) (User, bool) {
+	isLayer := false
+	for _, l := range p.Layers {
+		isLayer = isLayer || l == layer
+	}
+	if !isLayer {
+		return u, ok
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.lastGood == nil {
+		p.lastGood = make(map[IdentityProvider]map[string]User)
+		p.succeeded = make(map[IdentityProvider]bool)
+	}
+	layerUsers := p.lastGood[layer]
+	if layerUsers == nil {
+		layerUsers = make(map[string]User)
+		p.lastGood[layer] = layerUsers
+	}
+	if ok {
+		layerUsers[username] = u
+	} else {
+		delete(layerUsers, username)
+	}
+	u, ok = User{}, false
+	if p.revoked[username] {
+		return u, ok
+	}
+	for _, l := range p.Layers {
+		if layerUser, found := p.lastGood[l][username]; found {
+			u, ok = layerUser, true
+		}
+	}
+	return u, ok
+}
+
+// applyRevoked removes the revoked users from merged, it must be called with
+// the mutex held. Once all layers answered without a revoked user it is
+// forgotten, so that it can be provisioned again.
+func (p *LayeredProvider) applyRevoked(merged map[string]User, complete bool) {
+	changed := false
+	for username := range p.revoked {
+		if _, ok := merged[username]; ok {
+			delete(merged, username)
+		} else if complete {
+			log.Infof("Revoked user %s is gone from all identity providers", username)
+			delete(p.revoked, username)
+			changed = true
+		}
+	}
+	if changed {
+		p.saveRevoked()
+	}
+}
+
+// revoke removes username from the users of all layers until none returns
+// it anymore, or unrevoke is called
+func (p *LayeredProvider) revoke(username string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.revoked == nil {
+		p.revoked = make(map[string]bool)
+	}
+	if !p.revoked[username] {
+		p.revoked[username] = true
+		p.saveRevoked()
+	}
+}
+
+// unrevoke serves username from the layers again
+func (p *LayeredProvider) unrevoke(username string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.revoked[username] {
+		delete(p.revoked, username)
+		p.saveRevoked()
+	}
+}
+
+// loadRevoked reads the revoked usernames from RevokedPath
+func (p *LayeredProvider) loadRevoked() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.revoked = make(map[string]bool)
+	if p.RevokedPath == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(p.RevokedPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %v", p.RevokedPath, err)
+	}
+	var usernames []string
+	if err := json.Unmarshal(data, &usernames); err != nil {
+		return fmt.Errorf("Failed to parse %s: %v", p.RevokedPath, err)
+	}
+	for _, username := range usernames {
+		p.revoked[username] = true
+	}
+	return nil
+}
+
+// saveRevoked writes the revoked usernames to RevokedPath, it must be called
+// with the mutex held
+func (p *LayeredProvider) saveRevoked() {
+	if p.RevokedPath == "" {
+		return
+	}
+	usernames := []string{}
+	for username := range p.revoked {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	data, err := json.Marshal(usernames)
+	if err != nil {
+		log.Errorf("Failed to encode revoked users: %v", err)
+		return
+	}
+	if err := writeFileAtomic(p.RevokedPath, data); err != nil {
+		log.Error(err)
+	}
+}
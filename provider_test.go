@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/oswell/onelogin-go"
+	"github.com/patrickmn/go-cache"
+)
+
+// fakeOneLogin serves a OneLogin token and answers API paths with the JSON
+// that respond returns for them
+func fakeOneLogin(t *testing.T, respond func(path string, query map[string]string) interface{}) (*httptest.Server, *onelogin.OneLogin) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimLeft(r.URL.Path, "/")
+		var body interface{}
+		if path == "auth/oauth2/token" {
+			body = map[string]interface{}{"status": map[string]interface{}{}, "data": []map[string]interface{}{{"access_token": "token"}}}
+		} else if r.Header.Get("Authorization") != "bearer:token" {
+			body = map[string]interface{}{"status": map[string]interface{}{"error": true, "code": 401, "message": "Unauthorized"}}
+		} else {
+			query := make(map[string]string)
+			for name := range r.URL.Query() {
+				query[name] = r.URL.Query().Get(name)
+			}
+			body = respond(path, query)
+		}
+		if body == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			t.Error(err)
+		}
+	}))
+	client := onelogin.New("us", "id", "secret", "example", logging.ERROR)
+	client.CustomURL = server.URL
+	return server, client
+}
+
+// oneLoginPage is a page of OneLogin API results
+func oneLoginPage(data interface{}, afterCursor string) interface{} {
+	return map[string]interface{}{
+		"status":     map[string]interface{}{},
+		"pagination": map[string]interface{}{"after_cursor": afterCursor},
+		"data":       data,
+	}
+}
+
+func TestOneLoginProviderPagesRoles(t *testing.T) {
+	server, client := fakeOneLogin(t, func(path string, query map[string]string) interface{} {
+		switch path {
+		case onelogin.USER_GET_USERS:
+			return oneLoginPage([]onelogin.OneLoginUser{
+				{Id: 1, Username: "alice", Status: 1, Role_id: []int{1, 51}, Custom_attributes: map[string]string{"githubname": "alice-gh"}},
+			}, "")
+		case onelogin.ROLE_GET_ROLES:
+			if query["after_cursor"] == "" {
+				return oneLoginPage([]onelogin.OneLoginRole{{Id: 1, Name: "dev"}, {Id: 2, Name: "qa"}}, "page2")
+			}
+			return oneLoginPage([]onelogin.OneLoginRole{{Id: 51, Name: "ops"}}, "")
+		}
+		return nil
+	})
+	defer server.Close()
+
+	p := &OneLoginProvider{OneLogin: client}
+	got, err := p.Users()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := newUser("alice-gh")
+	alice.Roles = []string{"dev", "ops"}
+	if want := map[string]User{"alice": alice}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got users %v, want %v", got, want)
+	}
+}
+
+func TestOneLoginProviderRolesFailure(t *testing.T) {
+	server, client := fakeOneLogin(t, func(path string, query map[string]string) interface{} {
+		if path == onelogin.USER_GET_USERS {
+			return oneLoginPage([]onelogin.OneLoginUser{
+				{Id: 1, Username: "alice", Status: 1, Role_id: []int{1}, Custom_attributes: map[string]string{"githubname": "alice-gh"}},
+			}, "")
+		}
+		return map[string]interface{}{"status": map[string]interface{}{"error": true, "code": 500, "message": "Internal Server Error"}}
+	})
+	defer server.Close()
+
+	p := &OneLoginProvider{OneLogin: client}
+	if _, err := p.Users(); err == nil || !strings.Contains(err.Error(), "roles") {
+		t.Errorf("expected the refresh to fail on roles, got %v", err)
+	}
+}
+
+func TestOneLoginProviderIncremental(t *testing.T) {
+	gh := func(name string) map[string]string { return map[string]string{"githubname": name} }
+	var mutex sync.Mutex
+	roles := []onelogin.OneLoginRole{{Id: 1, Name: "dev"}, {Id: 2, Name: "ops"}}
+	all := []onelogin.OneLoginUser{
+		{Id: 1, Username: "alice", Status: 1, Role_id: []int{1}, Custom_attributes: gh("alice-gh")},
+		{Id: 2, Username: "bob", Status: 1, Role_id: []int{2}, Custom_attributes: gh("bob-gh")},
+		{Id: 3, Username: "dave", Status: 1, Role_id: []int{1}, Custom_attributes: gh("dave-gh")},
+	}
+	var updated []onelogin.OneLoginUser
+	var since []string
+	server, client := fakeOneLogin(t, func(path string, query map[string]string) interface{} {
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch path {
+		case onelogin.USER_GET_USERS:
+			since = append(since, query["updated_since"])
+			if query["updated_since"] != "" {
+				return oneLoginPage(updated, "")
+			}
+			return oneLoginPage(all, "")
+		case onelogin.ROLE_GET_ROLES:
+			return oneLoginPage(roles, "")
+		}
+		return nil
+	})
+	defer server.Close()
+	user := func(githubName string, roles ...string) User {
+		u := newUser(githubName)
+		u.Roles = roles
+		return u
+	}
+
+	p := &OneLoginProvider{OneLogin: client, FullRefresh: time.Hour}
+	got, err := p.Users()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]User{"alice": user("alice-gh", "dev"), "bob": user("bob-gh", "ops"), "dave": user("dave-gh", "dev")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got users %v after the full sync, want %v", got, want)
+	}
+
+	// the updated users are merged, a renamed role applies to users that
+	// weren't updated as well
+	mutex.Lock()
+	roles[0].Name = "developers"
+	updated = []onelogin.OneLoginUser{
+		{Id: 2, Username: "bob", Status: 1, Role_id: []int{2}, Custom_attributes: gh("bob-new")},
+		{Id: 3, Username: "dave", Status: 2, Role_id: []int{1}, Custom_attributes: gh("dave-gh")},
+		{Id: 4, Username: "erin", Status: 1, Role_id: []int{1, 2}, Custom_attributes: gh("erin-gh")},
+	}
+	mutex.Unlock()
+	start := time.Now()
+	if got, err = p.Users(); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]User{"alice": user("alice-gh", "developers"), "bob": user("bob-new", "ops"), "erin": user("erin-gh", "developers", "ops")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got users %v after the incremental sync, want %v", got, want)
+	}
+	mutex.Lock()
+	if len(since) != 2 || since[0] != "" {
+		t.Fatalf("got updated_since %q", since)
+	}
+	if updatedSince, err := time.Parse(time.RFC3339, since[1]); err != nil || updatedSince.After(start.Add(-oneLoginSyncOverlap)) {
+		t.Errorf("got updated_since %s, %v for an incremental sync started at %s", since[1], err, start)
+	}
+	mutex.Unlock()
+
+	// a refused full sync is followed by another full sync
+	pubkeyCache = cache.New(time.Minute, time.Minute)
+	users = got
+	p.fullSynced = time.Time{}
+	mutex.Lock()
+	all = all[:1]
+	updated = nil
+	mutex.Unlock()
+	if err := refreshTenantUsers("", p, &SyncGuard{MaxRemovedPercent: 50}); err == nil {
+		t.Fatal("expected the truncated refresh to be refused")
+	}
+	if _, err := p.Users(); err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	if len(since) != 4 || since[3] != "" {
+		t.Errorf("got updated_since %q after a refused sync, want a full sync", since)
+	}
+	mutex.Unlock()
+}
+
+func TestLayeredProviderIncomplete(t *testing.T) {
+	polled := &staticProvider{err: errors.New("unreachable")}
+	file := &staticProvider{users: map[string]User{"breakglass": {Keys: []string{testGithubKey}}}}
+	layered := &LayeredProvider{Layers: []IdentityProvider{polled, file}}
+	idp = layered
+	snapshot := map[string]User{"alice": newUser("alice-gh"), "breakglass": {Keys: []string{testGithubKey}}}
+	users = snapshot
+
+	err := refreshOneLoginUsers()
+	incomplete, ok := err.(*incompleteUsersError)
+	if !ok {
+		t.Fatalf("expected an incomplete refresh, got %v", err)
+	}
+	if !reflect.DeepEqual(incomplete.users, file.users) {
+		t.Errorf("got incomplete users %v, want %v", incomplete.users, file.users)
+	}
+	if !reflect.DeepEqual(users, snapshot) {
+		t.Errorf("incomplete refresh replaced the snapshot with %v", users)
+	}
+
+	polled.err = nil
+	polled.users = map[string]User{"alice": newUser("alice-gh"), "bob": newUser("bob-gh")}
+	if err := refreshOneLoginUsers(); err != nil {
+		t.Fatal(err)
+	}
+	polled.err = errors.New("unreachable")
+	if err := refreshOneLoginUsers(); err != nil {
+		t.Fatalf("expected the last known users of the failed layer, got %v", err)
+	}
+	if _, ok := users["bob"]; !ok || len(users) != 3 {
+		t.Errorf("got users %v after a failure with last known users", users)
+	}
+}
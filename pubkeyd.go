@@ -5,11 +5,12 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/fatz/ghpubkey-go/ghpubkey"
 	"github.com/gorilla/mux"
 	"github.com/op/go-logging"
 	"github.com/oswell/onelogin-go"
@@ -18,12 +19,33 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+const (
+	// how often config files are checked for changes
+	fileCheckInterval = 10 * time.Second
+	// how often the state file is saved
+	stateSaveInterval = time.Minute
+	// how often the users are refreshed while they are served from the state file
+	staleRetryInterval = 30 * time.Second
+)
+
 var (
 	log              = logging.MustGetLogger("pubkeyd")
-	users            map[string]string
+	users            map[string]User
+	usersStale       bool
 	refreshMutex     = &sync.RWMutex{}
 	pubkeyCache      *cache.Cache
 	ol               *onelogin.OneLogin
+	idp              IdentityProvider
+	principalRules   = make(PrincipalRules)
+	sharedAccounts   = make(SharedAccounts)
+	hostGroups       *HostGroups
+	fingerprintIndex = NewFingerprintIndex()
+	state            *State
+	prefetcher       *Prefetcher
+	responseSigner   *ResponseSigner
+	auditLog         *AuditLog
+	keyChanges       *KeyChangeNotifier
+	syncGuard        *SyncGuard
 	manualRefresh    chan (bool)
 	metricKnownUsers = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "pubkeyd_known_users",
@@ -38,6 +60,11 @@ var (
 		Help: "Number of authorized_keys requests, partitioned by status code and HTTP method.",
 	}, []string{"code", "method"},
 	)
+	metricAuthorizedPrincipalsRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubkeyd_authorized_principals_requests_total",
+		Help: "Number of authorized_principals requests, partitioned by status code and HTTP method.",
+	}, []string{"code", "method"},
+	)
 	metricGithubNameRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "pubkeyd_github_name_requests_total",
 		Help: "Number of github_name requests, partitioned by status code and HTTP method.",
@@ -49,37 +76,331 @@ func init() {
 	prometheus.MustRegister(metricKnownUsers)
 	prometheus.MustRegister(metricOneLoginRefreshesTotal)
 	prometheus.MustRegister(metricAuthorizedKeysRequestsTotal)
+	prometheus.MustRegister(metricAuthorizedPrincipalsRequestsTotal)
 	prometheus.MustRegister(metricGithubNameRequestsTotal)
 }
 
 // main function to boot up everything
 func main() {
+	provider := flag.String("provider", flagFromEnv("PROVIDER"), "Identity provider, one of onelogin, ldap, okta, file [env PROVIDER]")
 	shard := flag.String("shard", flagFromEnv("SHARD"), "OneLogin shard [env SHARD]")
 	clientID := flag.String("client-id", flagFromEnv("CLIENT_ID"), "OneLogin Client ID [env CLIENT_ID]")
 	clientSecret := flag.String("client-secret", flagFromEnv("CLIENT_SECRET"), "OneLogin Client Secret [env CLIENT_SECRET]")
 	subdomain := flag.String("subdomain", flagFromEnv("SUBDOMAIN"), "OneLogin Subdomain [env SUBDOMAIN]")
-	refreshInterval := flag.Int("refresh", 900, "OneLogin refresh interval in seconds")
+	oneLoginFullRefresh := flag.Int("onelogin-full-refresh", 0, "Fetch all OneLogin users only every this many seconds and in between only the users updated since the last refresh, 0 to always fetch all")
+	oneLoginEvents := flag.Int("onelogin-events", 0, "Poll the OneLogin events API every this many seconds to apply user changes right away, 0 to only refresh")
+	oneLoginEventsCursor := flag.String("onelogin-events-cursor", flagFromEnv("ONELOGIN_EVENTS_CURSOR"), "File to persist the position in the OneLogin events in [env ONELOGIN_EVENTS_CURSOR]")
+	oneLoginEventTypes := flag.String("onelogin-event-types", "USER_DEACTIVATED,USER_DELETED,USER_SUSPENDED,USER_UPDATED,CUSTOM_ATTRIBUTE_CHANGED", "Comma separated names or ids of the OneLogin event types that update the user")
+	ldapURL := flag.String("ldap-url", flagFromEnv("LDAP_URL"), "LDAP server URL, ldap:// or ldaps:// [env LDAP_URL]")
+	ldapBindDN := flag.String("ldap-bind-dn", flagFromEnv("LDAP_BIND_DN"), "LDAP bind DN [env LDAP_BIND_DN]")
+	ldapBindPassword := flag.String("ldap-bind-password", flagFromEnv("LDAP_BIND_PASSWORD"), "LDAP bind password [env LDAP_BIND_PASSWORD]")
+	ldapBaseDN := flag.String("ldap-base-dn", flagFromEnv("LDAP_BASE_DN"), "LDAP search base DN [env LDAP_BASE_DN]")
+	ldapObjectClass := flag.String("ldap-object-class", "person", "LDAP objectClass of user entries")
+	ldapUserAttr := flag.String("ldap-user-attr", "uid", "LDAP attribute holding the username, e.g. sAMAccountName for Active Directory")
+	ldapGithubAttr := flag.String("ldap-github-attr", "githubname", "LDAP attribute holding the github name")
+	ldapDisabledAttr := flag.String("ldap-disabled-attr", "", "LDAP attribute marking an account as disabled, e.g. nsAccountLock or pwdAccountLockedTime")
+	ldapCA := flag.String("ldap-ca", flagFromEnv("LDAP_CA"), "PEM file of CAs to verify ldaps:// servers with instead of the system roots [env LDAP_CA]")
+	oktaURL := flag.String("okta-url", flagFromEnv("OKTA_URL"), "Okta org URL, e.g. https://example.okta.com [env OKTA_URL]")
+	oktaToken := flag.String("okta-token", flagFromEnv("OKTA_TOKEN"), "Okta API Token [env OKTA_TOKEN]")
+	oktaUserAttr := flag.String("okta-user-attr", "login", "Okta profile property holding the username")
+	oktaGithubAttr := flag.String("okta-github-attr", "githubname", "Okta profile property holding the github name")
+	usersFile := flag.String("users-file", flagFromEnv("USERS_FILE"), "JSON or YAML file or directory of static users, reloaded on change [env USERS_FILE]")
+	usersFilePrecedence := flag.String("users-file-precedence", "file", "Which source wins when a user exists in both the users file and the provider, one of file, provider")
+	scimToken := flag.String("scim-token", flagFromEnv("SCIM_TOKEN"), "SCIM bearer token, enables the /scim/v2 endpoint [env SCIM_TOKEN]")
+	scimGithubAttr := flag.String("scim-github-attr", scimDefaultGithubAttr, "SCIM attribute holding the github name")
+	keysAttr := flag.String("keys-attr", "", "OneLogin custom attribute or Okta profile property holding SSH public keys, e.g. sshkeys")
+	keysAttrMerge := flag.Bool("keys-attr-merge", true, "Serve keys from -keys-attr together with the github keys instead of in place of them")
+	githubHosts := flag.String("github-hosts", flagFromEnv("GITHUB_HOSTS"), "JSON file of additional GitHub (Enterprise) hosts [env GITHUB_HOSTS]")
+	gitlabURL := flag.String("gitlab-url", "https://gitlab.com", "GitLab URL for gitlab: accounts, empty to disable")
+	giteaURL := flag.String("gitea-url", "https://gitea.com", "Gitea URL for gitea: accounts, empty to disable")
+	bitbucketURL := flag.String("bitbucket-url", "https://api.bitbucket.org", "Bitbucket API URL for bitbucket: accounts, empty to disable")
+	bitbucketToken := flag.String("bitbucket-token", flagFromEnv("BITBUCKET_TOKEN"), "Bitbucket access token, or app password as username:app-password [env BITBUCKET_TOKEN]")
+	signingKey := flag.String("signing-key", flagFromEnv("SIGNING_KEY"), "Ed25519 private key file to sign authorized_keys responses with [env SIGNING_KEY]")
+	caKey := flag.String("ca-key", flagFromEnv("CA_KEY"), "SSH CA private key file, enables issuing user certificates [env CA_KEY]")
+	caValidity := flag.Int("ca-validity", 3600, "Validity of issued user certificates in seconds")
+	caExtensions := flag.String("ca-extensions", "permit-pty,permit-port-forwarding,permit-agent-forwarding,permit-X11-forwarding,permit-user-rc", "Comma separated extensions of issued user certificates")
+	caRolePrincipals := flag.Bool("ca-role-principals", false, "Add the users roles as role:<name> principals of issued certificates")
+	principalsFile := flag.String("principals-file", flagFromEnv("PRINCIPALS_FILE"), "JSON file mapping local accounts to the roles that may log in to them [env PRINCIPALS_FILE]")
+	sharedAccountsFile := flag.String("shared-accounts-file", flagFromEnv("SHARED_ACCOUNTS_FILE"), "JSON file mapping shared local accounts to the roles whose keys they accept [env SHARED_ACCOUNTS_FILE]")
+	hostGroupsFile := flag.String("host-groups-file", flagFromEnv("HOST_GROUPS_FILE"), "JSON file mapping host groups to the roles that may log in, reloaded on change [env HOST_GROUPS_FILE]")
+	fingerprintCrawl := flag.Int("fingerprint-crawl", 0, "Fetch the keys of all users for the fingerprint index every this many seconds, 0 to only index keys as they are requested")
+	stateFile := flag.String("state-file", flagFromEnv("STATE_FILE"), "JSON file to persist users and keys in, served from on startup while the identity provider is down [env STATE_FILE]")
+	cacheSoftTTL := flag.Int("cache-soft-ttl", 120, "Seconds after which cached keys are refreshed in the background")
+	cacheHardTTL := flag.Int("cache-hard-ttl", 600, "Seconds after which cached keys are refreshed before they are served")
+	cacheMaxStale := flag.Int("cache-max-stale", 86400, "Seconds for which the last known keys are served while they can't be refreshed, 0 to never serve them")
+	prefetchWorkers := flag.Int("prefetch-workers", 4, "Number of workers prefetching the keys of all users after each refresh, 0 to disable")
+	prefetchJitter := flag.Int("prefetch-jitter", 30, "Maximum random delay in seconds before prefetching")
+	auditLogFile := flag.String("audit-log", flagFromEnv("AUDIT_LOG"), "File to write JSON audit events of key lookups to [env AUDIT_LOG]")
+	auditLogMaxSize := flag.Int("audit-log-max-size", 100, "Size in MB at which the audit log is rotated, 0 to never rotate")
+	auditLogBackups := flag.Int("audit-log-backups", 10, "Number of rotated audit logs to keep")
+	auditLogChain := flag.Bool("audit-log-chain", false, "Chain audit events by hash so that tampering can be detected")
+	auditLogKeyFile := flag.String("audit-log-key-file", flagFromEnv("AUDIT_LOG_KEY_FILE"), "File holding a secret key to chain audit events by HMAC-SHA256 with, implies -audit-log-chain [env AUDIT_LOG_KEY_FILE]")
+	verifyAudit := flag.Bool("verify-audit-log", false, "Verify the hash chain of the audit log files given as arguments, oldest first, and exit")
+	webhooksFile := flag.String("webhooks-file", flagFromEnv("WEBHOOKS_FILE"), "JSON file of webhooks notified when the keys of a user change [env WEBHOOKS_FILE]")
+	webhookRetries := flag.Int("webhook-retries", 5, "Number of times a failed webhook delivery is retried")
+	syncGuardPercent := flag.Float64("sync-guard-percent", 50, "Refuse users refreshes that remove more than this percentage of the users, 0 to disable")
+	syncGuardUsers := flag.Int("sync-guard-users", 0, "Refuse users refreshes that remove more than this many users, 0 to disable")
+	syncGuardMinUsers := flag.Int("sync-guard-min-users", 5, "Never refuse users refreshes that remove at most this many users")
+	tenantsFile := flag.String("tenants-file", flagFromEnv("TENANTS_FILE"), "JSON file of further OneLogin tenants whose users are served under /t/{tenant} [env TENANTS_FILE]")
+	refreshInterval := flag.Int("refresh", 900, "Identity provider refresh interval in seconds")
 	auth := flag.String("auth", flagFromEnv("AUTH"), "Authentication Token [env AUTH]")
 	refreshAuth := flag.String("refresh-auth", flagFromEnv("REFRESH_AUTH"), "OneLogin Cache Refresh Authentication Token [env REFRESH_AUTH]")
+	tokensFile := flag.String("tokens-file", flagFromEnv("TOKENS_FILE"), "JSON file of named API tokens and their scopes, reloaded on change [env TOKENS_FILE]")
 	port := flag.Int("port", 2020, "TCP port to listen on")
+	tlsCert := flag.String("tls-cert", flagFromEnv("TLS_CERT"), "TLS certificate file, enables HTTPS, reloaded on change [env TLS_CERT]")
+	tlsKey := flag.String("tls-key", flagFromEnv("TLS_KEY"), "TLS private key file, reloaded on change [env TLS_KEY]")
+	tlsClientCA := flag.String("tls-client-ca", flagFromEnv("TLS_CLIENT_CA"), "PEM file of CAs to verify client certificates with, reloaded on change [env TLS_CLIENT_CA]")
+	tlsRequireClientCert := flag.Bool("tls-require-client-cert", false, "Refuse clients without a valid client certificate, requires tls-client-ca")
 	verbose := flag.Bool("verbose", false, "Verbose logging")
 	flag.Parse()
 
+	var auditKey []byte
+	if *auditLogKeyFile != "" {
+		var err error
+		if auditKey, err = loadAuditKey(*auditLogKeyFile); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		*auditLogChain = true
+	}
+	if *verifyAudit {
+		count, err := verifyAuditLog(flag.Args(), auditKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Audit log verification failed after %d events: %v\n", count, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Verified %d audit events\n", count)
+		os.Exit(0)
+	}
+
 	loglevel := logging.ERROR
 	if *verbose {
 		loglevel = logging.DEBUG
 	}
 
-	if *clientID == "" || *clientSecret == "" {
-		log.Error("Args client-id and client-secret are required")
+	if *gitlabURL != "" {
+		keySources["gitlab"] = &KeysFileSource{BaseURL: strings.TrimSuffix(*gitlabURL, "/")}
+	}
+	if *giteaURL != "" {
+		keySources["gitea"] = &KeysFileSource{BaseURL: strings.TrimSuffix(*giteaURL, "/")}
+	}
+	if *bitbucketURL != "" {
+		keySources["bitbucket"] = &BitbucketKeySource{BaseURL: strings.TrimSuffix(*bitbucketURL, "/"), Token: *bitbucketToken}
+	}
+	if *githubHosts != "" {
+		if err := loadGithubHosts(*githubHosts); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	var oneLoginProvider *OneLoginProvider
+	switch *provider {
+	case "onelogin":
+		if *clientID == "" || *clientSecret == "" {
+			log.Error("Args client-id and client-secret are required")
+			os.Exit(1)
+		}
+		ol = onelogin.New(*shard, *clientID, *clientSecret, *subdomain, loglevel)
+		oneLoginProvider = &OneLoginProvider{
+			OneLogin:    ol,
+			Keys:        KeysAttribute{Name: *keysAttr, Merge: *keysAttrMerge},
+			FullRefresh: time.Duration(*oneLoginFullRefresh) * time.Second,
+		}
+		idp = oneLoginProvider
+	case "ldap":
+		if *ldapURL == "" || *ldapBaseDN == "" {
+			log.Error("Args ldap-url and ldap-base-dn are required")
+			os.Exit(1)
+		}
+		ldapProvider := &LDAPProvider{
+			URL:          *ldapURL,
+			BindDN:       *ldapBindDN,
+			BindPassword: *ldapBindPassword,
+			BaseDN:       *ldapBaseDN,
+			ObjectClass:  *ldapObjectClass,
+			UserAttr:     *ldapUserAttr,
+			GithubAttr:   *ldapGithubAttr,
+			DisabledAttr: *ldapDisabledAttr,
+		}
+		if *ldapCA != "" {
+			var err error
+			if ldapProvider.RootCAs, err = loadLDAPCA(*ldapCA); err != nil {
+				log.Error(err)
+				os.Exit(1)
+			}
+		}
+		idp = ldapProvider
+	case "okta":
+		if *oktaURL == "" || *oktaToken == "" {
+			log.Error("Args okta-url and okta-token are required")
+			os.Exit(1)
+		}
+		idp = &OktaProvider{
+			URL:        strings.TrimSuffix(*oktaURL, "/"),
+			Token:      *oktaToken,
+			UserAttr:   *oktaUserAttr,
+			GithubAttr: *oktaGithubAttr,
+			Keys:       KeysAttribute{Name: *keysAttr, Merge: *keysAttrMerge},
+		}
+	case "file":
+		if *usersFile == "" {
+			log.Error("Arg users-file is required")
+			os.Exit(1)
+		}
+	default:
+		log.Errorf("Unknown identity provider %s", *provider)
 		os.Exit(1)
 	}
-	ol = onelogin.New(*shard, *clientID, *clientSecret, *subdomain, loglevel)
+	var scimServer *SCIMServer
+	if *scimToken != "" {
+		scimPath := ""
+		if *stateFile != "" {
+			scimPath = *stateFile + ".scim"
+		} else {
+			log.Warning("Users provisioned through SCIM are lost on restart without -state-file")
+		}
+		var err error
+		if scimServer, err = NewSCIMServer(*scimToken, *scimGithubAttr, scimPath); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+	// SCIM and static users are layered over the users of the identity
+	// provider, later layers take precedence
+	var layers []IdentityProvider
+	if idp != nil {
+		layers = append(layers, idp)
+	}
+	if scimServer != nil {
+		layers = append(layers, scimServer)
+	}
+	var fileProvider *FileProvider
+	if *usersFile != "" {
+		fileProvider = &FileProvider{Path: *usersFile}
+		switch *usersFilePrecedence {
+		case "file":
+			layers = append(layers, fileProvider)
+		case "provider":
+			layers = append([]IdentityProvider{fileProvider}, layers...)
+		default:
+			log.Errorf("Unknown users file precedence %s", *usersFilePrecedence)
+			os.Exit(1)
+		}
+	}
+	if len(layers) == 1 {
+		idp = layers[0]
+	} else {
+		layered := &LayeredProvider{Layers: layers}
+		if *stateFile != "" {
+			layered.RevokedPath = *stateFile + ".revoked"
+		}
+		if err := layered.loadRevoked(); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		idp = layered
+	}
 
-	if err := refreshOneLoginUsers(); err != nil {
-		log.Error(err)
+	if *principalsFile != "" {
+		var err error
+		if principalRules, err = loadPrincipalRules(*principalsFile); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	if *sharedAccountsFile != "" {
+		var err error
+		if sharedAccounts, err = loadSharedAccounts(*sharedAccountsFile); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	if *tenantsFile != "" {
+		var err error
+		if tenants, err = loadTenants(*tenantsFile); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	if *hostGroupsFile != "" {
+		var err error
+		if hostGroups, err = NewHostGroups(*hostGroupsFile); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		go hostGroups.Watch(fileCheckInterval)
+	}
+
+	keyCache = KeyCachePolicy{
+		SoftTTL:  time.Duration(*cacheSoftTTL) * time.Second,
+		HardTTL:  time.Duration(*cacheHardTTL) * time.Second,
+		MaxStale: time.Duration(*cacheMaxStale) * time.Second,
+	}
+	if keyCache.HardTTL < keyCache.SoftTTL {
+		log.Error("Arg cache-hard-ttl must not be shorter than cache-soft-ttl")
 		os.Exit(1)
 	}
+	pubkeyCache = cache.New(keyCache.expiration(), 10*time.Minute)
+	if *prefetchWorkers > 0 {
+		prefetcher = &Prefetcher{Workers: *prefetchWorkers, Jitter: time.Duration(*prefetchJitter) * time.Second}
+	}
+	if *webhooksFile != "" {
+		var err error
+		if keyChanges, err = NewKeyChangeNotifier(*webhooksFile, *webhookRetries); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+	if *syncGuardPercent > 0 || *syncGuardUsers > 0 {
+		syncGuard = &SyncGuard{MaxRemovedPercent: *syncGuardPercent, MaxRemovedUsers: *syncGuardUsers, MinRemovedUsers: *syncGuardMinUsers}
+	}
+	if *stateFile != "" {
+		state = NewState(*stateFile)
+		if snapshot, err := state.load(); err != nil {
+			log.Error(err)
+		} else {
+			users = snapshot
+			for user := range users {
+				if tenant := userTenant(user); tenant != "" && tenants[tenant] == nil {
+					delete(users, user)
+				}
+			}
+			setKnownUsers("")
+			for tenant := range tenants {
+				setKnownUsers(tenant)
+			}
+		}
+	}
+
+	if err := refreshOneLoginUsers(); err != nil {
+		if users == nil {
+			incomplete, ok := err.(*incompleteUsersError)
+			if !ok {
+				log.Error(err)
+				os.Exit(1)
+			}
+			// without a state file the users of the identity providers that
+			// answered are better than none
+			setUsers("", incomplete.users)
+			log.Errorf("Serving %d users until all identity providers recover: %v", len(users), err)
+		} else {
+			log.Errorf("Serving %d users from state file until the identity provider recovers: %v", len(users), err)
+		}
+		usersStale = true
+		metricStale.Set(1)
+		go func() {
+			for refreshOneLoginUsers() != nil {
+				time.Sleep(staleRetryInterval)
+			}
+		}()
+	}
+	if state != nil {
+		go state.run(stateSaveInterval)
+	}
 
 	refreshTicker := time.NewTicker(time.Duration(*refreshInterval) * time.Second)
 	quit := make(chan struct{})
@@ -97,151 +418,494 @@ func main() {
 			}
 		}
 	}()
+	if fileProvider != nil {
+		go fileProvider.Watch(fileCheckInterval, func() { manualRefresh <- true })
+	}
+	if *oneLoginEvents > 0 {
+		if oneLoginProvider == nil {
+			log.Error("Arg onelogin-events requires the onelogin provider")
+			os.Exit(1)
+		}
+		eventSync, err := NewOneLoginEventSync(oneLoginProvider, *oneLoginEventsCursor, strings.Split(*oneLoginEventTypes, ","))
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		go eventSync.run(time.Duration(*oneLoginEvents) * time.Second)
+	}
+	for _, tenant := range tenants {
+		if err := tenant.start(loglevel, time.Duration(*refreshInterval)*time.Second, syncGuard, strings.Split(*oneLoginEventTypes, ",")); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	authenticator, err := NewAuthenticator(*tokensFile, legacyTokens(*auth, *refreshAuth))
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	if *tokensFile != "" {
+		go authenticator.Watch(fileCheckInterval)
+	}
 
-	pubkeyCache = cache.New(2*time.Minute, 10*time.Minute)
-	router := mux.NewRouter()
+	// base64 fingerprints may contain //, which path cleaning would redirect
+	router := mux.NewRouter().SkipClean(true)
 	listenOn := ":" + strconv.Itoa(*port)
 	router.HandleFunc("/health", getHealth).Methods("GET")
 	router.PathPrefix("/metrics").Handler(promhttp.Handler())
-	// fixme: refactor this
-	if *auth == "" {
-		router.HandleFunc("/authorized_keys/{id}", getAuthorizedKeys).Methods("GET")
-		router.HandleFunc("/authorized_keys/{id}", deleteAuthorizedKeys).Methods("DELETE")
-		router.HandleFunc("/github_name/{id}", getGithubName).Methods("GET")
-	} else {
-		router.HandleFunc("/authorized_keys/{id}", getAuthorizedKeys).Methods("GET").Queries("auth", *auth)
-		router.HandleFunc("/authorized_keys/{id}", deleteAuthorizedKeys).Methods("DELETE").Queries("auth", *auth)
-		router.HandleFunc("/github_name/{id}", getGithubName).Methods("GET").Queries("auth", *auth)
+	// the vendored mux skips the middleware of subrouters after a subrouter
+	// that didn't match, so the middleware wraps each handler
+	read := authenticator.require(scopeRead)
+	purge := authenticator.require(scopePurge)
+	refresh := authenticator.require(scopeRefresh)
+	router.Handle("/authorized_keys/{id}", read(http.HandlerFunc(getAuthorizedKeys))).Methods("GET")
+	router.Handle("/authorized_keys/{id}", purge(http.HandlerFunc(deleteAuthorizedKeys))).Methods("DELETE")
+	router.Handle("/authorized_principals/{id}", read(http.HandlerFunc(getAuthorizedPrincipals))).Methods("GET")
+	router.Handle("/github_name/{id}", read(http.HandlerFunc(getGithubName))).Methods("GET")
+	router.Handle("/fingerprint/{fp:.+}", read(http.HandlerFunc(getFingerprint))).Methods("GET")
+	router.Handle("/refresh", refresh(http.HandlerFunc(doRefresh))).Methods("GET")
+	if tenants != nil {
+		router.Handle("/t/{tenant}/authorized_keys/{id}", read(http.HandlerFunc(getAuthorizedKeys))).Methods("GET")
+		router.Handle("/t/{tenant}/authorized_keys/{id}", purge(http.HandlerFunc(deleteAuthorizedKeys))).Methods("DELETE")
+		router.Handle("/t/{tenant}/github_name/{id}", read(http.HandlerFunc(getGithubName))).Methods("GET")
 	}
-	if *refreshAuth == "" {
-		if *auth == "" {
-			router.HandleFunc("/refresh", doRefresh).Methods("GET")
-		} else {
-			router.HandleFunc("/refresh", doRefresh).Methods("GET").Queries("auth", *auth)
+	if syncGuard != nil {
+		if *tokensFile == "" && authenticator.open(scopeRefresh) {
+			log.Warning("Refused refreshes can't be accepted without -auth, -refresh-auth or -tokens-file")
+		}
+		admin := authenticator.requireAdmin()
+		syncGuard.Register(router, admin)
+		for _, tenant := range tenants {
+			tenant.guard.Register(router, admin)
 		}
-	} else {
-		router.HandleFunc("/refresh", doRefresh).Methods("GET").Queries("auth", *refreshAuth)
 	}
-	log.Infof("Listening on %s", listenOn)
-	log.Fatal(http.ListenAndServe(listenOn, router))
+	if *caKey != "" {
+		var extensions []string
+		if *caExtensions != "" {
+			extensions = strings.Split(*caExtensions, ",")
+		}
+		ca, err := NewCertificateAuthority(*caKey, time.Duration(*caValidity)*time.Second, extensions, *caRolePrincipals)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		ca.Register(router)
+	}
+	if *signingKey != "" {
+		if responseSigner, err = NewResponseSigner(*signingKey); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		responseSigner.Register(router)
+	}
+	if scimServer != nil {
+		scimServer.Register(router)
+	}
+	if *auditLogFile != "" {
+		if auditLog, err = NewAuditLog(*auditLogFile, int64(*auditLogMaxSize)*1024*1024, *auditLogBackups, *auditLogChain, auditKey); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+	if *fingerprintCrawl > 0 {
+		go fingerprintIndex.crawl(time.Duration(*fingerprintCrawl) * time.Second)
+	}
+	if *tlsCert == "" && (*tlsClientCA != "" || *tlsRequireClientCert) {
+		log.Error("Arg tls-cert is required with tls-client-ca or tls-require-client-cert")
+		os.Exit(1)
+	}
+	if *tlsCert == "" {
+		log.Infof("Listening on %s", listenOn)
+		log.Fatal(http.ListenAndServe(listenOn, router))
+	}
+	if *tlsKey == "" {
+		log.Error("Arg tls-key is required with tls-cert")
+		os.Exit(1)
+	}
+	tlsReloader, err := NewTLSReloader(*tlsCert, *tlsKey, *tlsClientCA, *tlsRequireClientCert)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	tlsReloader.Watch(fileCheckInterval)
+	server := &http.Server{Addr: listenOn, Handler: router, TLSConfig: tlsReloader.TLSConfig()}
+	log.Infof("Listening on %s with TLS", listenOn)
+	log.Fatal(server.ListenAndServeTLS("", ""))
 }
 
 func refreshOneLoginUsers() error {
-	log.Debug("Refreshing OneLogin users")
-	githubUsers, err := getGithubUsers(*ol)
+	return refreshTenantUsers("", idp, syncGuard)
+}
+
+// refreshTenantUsers replaces the users of tenant with the ones of provider
+// unless guard refuses it
+func refreshTenantUsers(tenant string, provider IdentityProvider, guard *SyncGuard) error {
+	log.Debugf("Refreshing users%s", tenantLabel(tenant))
+	githubUsers, err := provider.Users()
+	if err != nil {
+		return err
+	}
+	refreshMutex.RLock()
+	err = guard.check(tenantUsers(tenant), githubUsers)
+	refreshMutex.RUnlock()
 	if err != nil {
+		log.Error(err)
+		// the next sync must not build on the refused users
+		if r, ok := provider.(resyncer); ok {
+			r.resync()
+		}
 		return err
 	}
+	setUsers(tenant, githubUsers)
+	if tenant == "" {
+		metricOneLoginRefreshesTotal.Inc()
+	} else {
+		metricTenantRefreshesTotal.WithLabelValues(tenant).Inc()
+	}
+	return nil
+}
+
+// setUsers replaces all users of tenant, keeping the users of the other
+// tenants
+func setUsers(tenant string, githubUsers map[string]User) {
 	refreshMutex.Lock()
-	users = githubUsers
+	merged := make(map[string]User, len(users)+len(githubUsers))
+	for user, u := range users {
+		if userTenant(user) != tenant {
+			merged[user] = u
+		}
+	}
+	for user, u := range githubUsers {
+		if !validUsername(user) {
+			log.Errorf("Ignoring user %q%s, usernames can't contain NUL", user, tenantLabel(tenant))
+			continue
+		}
+		merged[tenantQualified(tenant, user)] = u
+	}
+	// the keys of removed users and of users with other accounts must not be
+	// served from the cache or the state file
+	for user, u := range users {
+		if current, ok := merged[user]; !ok || !current.sameKeys(u) {
+			purgeAuthorizedKeys(user)
+			fingerprintIndex.forget(user)
+		}
+	}
+	users = merged
+	if usersStale && tenant == "" {
+		log.Info("Identity provider recovered, no longer serving users from state file")
+		usersStale = false
+	}
+	setKnownUsers(tenant)
 	refreshMutex.Unlock()
-	metricKnownUsers.Set(float64(len(githubUsers)))
-	metricOneLoginRefreshesTotal.Inc()
-	return nil
+	state.touch()
+	if tenant == "" {
+		metricStale.Set(0)
+	}
+	prefetcher.start()
+}
+
+// setUser adds or updates a single user in between refreshes
+func setUser(user string, u User) {
+	refreshMutex.Lock()
+	purgeAuthorizedKeys(user)
+	users[user] = u
+	setKnownUsers(userTenant(user))
+	refreshMutex.Unlock()
+	state.touch()
+}
+
+// revokeUser removes username right away, also if other layers than layer
+// still return it, until none of them does anymore
+func revokeUser(layer IdentityProvider, username string) string {
+	if layered, isLayered := idp.(*LayeredProvider); isLayered {
+		layered.revoke(username)
+	}
+	return updateUser(layer, username, User{}, false)
+}
+
+// unrevokeUser serves a revoked username from all layers again, once the
+// layer that revoked it provisions it again
+func unrevokeUser(username string) {
+	if layered, isLayered := idp.(*LayeredProvider); isLayered {
+		layered.unrevoke(username)
+	}
+}
+
+// updateUser applies a change of username that layer reports in between
+// refreshes, u is the new user unless ok is false because the user is gone
+// from layer. The change is merged with the other identity providers like a
+// refresh would and returns set, delete or "" if nothing changed.
+func updateUser(layer IdentityProvider, username string, u User, ok bool) string {
+	if layered, isLayered := idp.(*LayeredProvider); isLayered {
+		u, ok = layered.resolve(layer, username, u, ok)
+	}
+	refreshMutex.RLock()
+	current, known := users[username]
+	refreshMutex.RUnlock()
+	switch {
+	case ok && !(known && reflect.DeepEqual(current, u)):
+		setUser(username, u)
+		return "set"
+	case !ok && known:
+		deleteUser(username)
+		return "delete"
+	}
+	return ""
+}
+
+// deleteUser removes a single user in between refreshes
+func deleteUser(user string) {
+	refreshMutex.Lock()
+	delete(users, user)
+	purgeAuthorizedKeys(user)
+	fingerprintIndex.forget(user)
+	setKnownUsers(userTenant(user))
+	refreshMutex.Unlock()
+	state.touch()
+}
+
+// setKnownUsers updates the known users metric of tenant, it must be called
+// with refreshMutex held
+func setKnownUsers(tenant string) {
+	count := 0
+	for user := range users {
+		if userTenant(user) == tenant {
+			count++
+		}
+	}
+	if tenant == "" {
+		metricKnownUsers.Set(float64(count))
+	} else {
+		metricTenantKnownUsers.WithLabelValues(tenant).Set(float64(count))
+	}
+}
+
+// countAuthorizedKeysRequest counts an authorized_keys request for a user of
+// tenant
+func countAuthorizedKeysRequest(tenant string, code string, method string) {
+	if tenant == "" {
+		metricAuthorizedKeysRequestsTotal.WithLabelValues(code, method).Inc()
+	} else {
+		metricTenantAuthorizedKeysRequestsTotal.WithLabelValues(tenant, code, method).Inc()
+	}
+}
+
+// countGithubNameRequest counts a github_name request for a user of tenant
+func countGithubNameRequest(tenant string, code string, method string) {
+	if tenant == "" {
+		metricGithubNameRequestsTotal.WithLabelValues(code, method).Inc()
+	} else {
+		metricTenantGithubNameRequestsTotal.WithLabelValues(tenant, code, method).Inc()
+	}
 }
 
 func deleteAuthorizedKeys(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	user := params["id"]
-	log.Debugf("Received request to purge authorized_keys cache of user %s", user)
-	pubkeyCache.Delete(user)
+	user, tenant, err := requestedUser(r)
 	w.Header().Set("Content-Type", "text/plain")
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404 user not found\n"))
+		countAuthorizedKeysRequest("", "404", "DELETE")
+		return
+	}
+	log.Debugf("Received request to purge authorized_keys cache of user %s", displayUser(user))
+	purgeAuthorizedKeys(user)
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Purging authorized_keys cache for user " + user + "\n"))
-	metricAuthorizedKeysRequestsTotal.WithLabelValues("200", "DELETE").Inc()
+	w.Write([]byte("Purging authorized_keys cache for user " + displayUser(user) + "\n"))
+	countAuthorizedKeysRequest(tenant, "200", "DELETE")
 }
 
 func doRefresh(w http.ResponseWriter, r *http.Request) {
 	log.Debug("Received request to refresh OneLogin users")
 	manualRefresh <- true
+	refreshTenants()
 	w.Header().Set("Content-Type", "text/plain")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Refreshing OneLogin users\n"))
 }
 
 func getAuthorizedKeys(w http.ResponseWriter, r *http.Request) {
+	user, tenant, err := requestedUser(r)
+	// responses are signed for the name the client asked for, a request
+	// can't ask for a username with a slash
 	params := mux.Vars(r)
-	user := params["id"]
+	name := params["id"]
+	if params["tenant"] != "" {
+		name = params["tenant"] + "/" + name
+	}
+	event := newAuditEvent(r, params["id"])
+	event.Tenant = tenant
+	defer auditLog.record(event)
+	w.Header().Set("Content-Type", "text/plain")
+	if err != nil {
+		log.Error(err)
+		event.Status = http.StatusNotFound
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404 user not found\n"))
+		countAuthorizedKeysRequest("", "404", "GET")
+		return
+	}
+	entitled, err := hostGroups.entitled(r)
+	if err != nil {
+		log.Errorf("Refusing authorized_keys request from %s: %v", clientHost(r), err)
+		event.Status = http.StatusForbidden
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 " + err.Error() + "\n"))
+		countAuthorizedKeysRequest(tenant, "403", "GET")
+		return
+	}
+	if _, shared := sharedAccounts[user]; shared && tenant == "" {
+		getSharedAuthorizedKeys(w, r, user, entitled, event)
+		return
+	}
 	refreshMutex.RLock()
-	githubName, ok := users[user]
+	u, ok := users[user]
+	stale := usersStale && tenant == ""
 	refreshMutex.RUnlock()
-	w.Header().Set("Content-Type", "text/plain")
+	if ok && !entitled(u) {
+		log.Infof("User %s is not entitled to log in to host group of %s", displayUser(user), clientHost(r))
+		ok = false
+	}
 	if ok {
-		log.Infof("Found user %s with github name %s", user, githubName)
-		var authorizedKeys string
-		cachedAuthorizedKeys, found := pubkeyCache.Get(user)
-		if found {
-			log.Debugf("authorized_keys for user %s found in cache", user)
-			authorizedKeys = cachedAuthorizedKeys.(string)
-		} else {
-			log.Debugf("authorized_keys for user %s not found in cache", user)
-			g := ghpubkey.NewGHPubKey()
-			var err error
-			authorizedKeys, err = g.RequestKeysForUser(githubName)
-			if err != nil {
-				log.Errorf("User %s found but authorized_keys unretrievable", user)
-				w.WriteHeader(http.StatusServiceUnavailable)
-				w.Write([]byte("503 couldn't retrieve users authorized_keys\n"))
-				metricAuthorizedKeysRequestsTotal.WithLabelValues("503", "GET").Inc()
-				return
-			}
-			pubkeyCache.Set(user, authorizedKeys, cache.DefaultExpiration)
+		log.Infof("Found user %s with github name %s", displayUser(user), u.GithubName)
+		event.GithubName = u.GithubName
+		authorizedKeys, cacheResult, err := cachedAuthorizedKeys(user, u)
+		event.Cache = cacheResult
+		if err != nil {
+			log.Errorf("User %s found but authorized_keys unretrievable: %v", displayUser(user), err)
+			event.Status = http.StatusServiceUnavailable
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("503 couldn't retrieve users authorized_keys\n"))
+			countAuthorizedKeysRequest(tenant, "503", "GET")
+			return
 		}
-		log.Infof("Returning authorized_keys of github user %s", githubName)
+		log.Infof("Returning authorized_keys of user %s", displayUser(user))
+		event.Status = http.StatusOK
+		event.setKeys(authorizedKeys)
+		markStale(w, stale || cacheResult == cacheStale)
+		responseSigner.sign(w, r, name, []byte(authorizedKeys))
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(authorizedKeys))
-		metricAuthorizedKeysRequestsTotal.WithLabelValues("200", "GET").Inc()
+		countAuthorizedKeysRequest(tenant, "200", "GET")
 		return
 	}
-	log.Errorf("User %s not found", user)
+	log.Errorf("User %s not found", displayUser(user))
+	event.Status = http.StatusNotFound
 	w.WriteHeader(http.StatusNotFound)
 	w.Write([]byte("404 user not found\n"))
-	metricAuthorizedKeysRequestsTotal.WithLabelValues("404", "GET").Inc()
+	countAuthorizedKeysRequest(tenant, "404", "GET")
 }
 
-func getGithubName(w http.ResponseWriter, r *http.Request) {
+func getSharedAuthorizedKeys(w http.ResponseWriter, r *http.Request, account string, entitled func(User) bool, event *AuditEvent) {
+	refreshMutex.RLock()
+	members := sharedAccounts.members(account, users, entitled)
+	stale := usersStale
+	refreshMutex.RUnlock()
+	authorizedKeys, cacheResult, err := sharedAuthorizedKeys(account, members)
+	event.Cache = cacheResult
+	if err != nil {
+		log.Error(err)
+		event.Status = http.StatusServiceUnavailable
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("503 couldn't retrieve shared accounts authorized_keys\n"))
+		metricAuthorizedKeysRequestsTotal.WithLabelValues("503", "GET").Inc()
+		return
+	}
+	if authorizedKeys == "" {
+		log.Errorf("Shared account %s has no members with keys", account)
+		event.Status = http.StatusNotFound
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404 user not found\n"))
+		metricAuthorizedKeysRequestsTotal.WithLabelValues("404", "GET").Inc()
+		return
+	}
+	log.Infof("Returning authorized_keys of %d members of shared account %s", len(members), account)
+	event.Status = http.StatusOK
+	event.setKeys(authorizedKeys)
+	markStale(w, stale || cacheResult == cacheStale)
+	responseSigner.sign(w, r, account, []byte(authorizedKeys))
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(authorizedKeys))
+	metricAuthorizedKeysRequestsTotal.WithLabelValues("200", "GET").Inc()
+}
+
+func getAuthorizedPrincipals(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
+	account := params["id"]
+	w.Header().Set("Content-Type", "text/plain")
+	entitled, err := hostGroups.entitled(r)
+	if err != nil {
+		log.Errorf("Refusing authorized_principals request from %s: %v", clientHost(r), err)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 " + err.Error() + "\n"))
+		metricAuthorizedPrincipalsRequestsTotal.WithLabelValues("403", "GET").Inc()
+		return
+	}
 	refreshMutex.RLock()
-	githubName, ok := users[params["id"]]
+	principals := principalRules.principals(account, users, entitled)
+	stale := usersStale
 	refreshMutex.RUnlock()
+	if len(principals) > 0 {
+		log.Infof("Returning %d authorized_principals of account %s", len(principals), account)
+		markStale(w, stale)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(strings.Join(principals, "\n") + "\n"))
+		metricAuthorizedPrincipalsRequestsTotal.WithLabelValues("200", "GET").Inc()
+		return
+	}
+	log.Errorf("Account %s not found", account)
+	w.WriteHeader(http.StatusNotFound)
+	w.Write([]byte("404 account not found\n"))
+	metricAuthorizedPrincipalsRequestsTotal.WithLabelValues("404", "GET").Inc()
+}
+
+// markStale tells clients that the response is served from the state file
+func markStale(w http.ResponseWriter, stale bool) {
+	if stale {
+		w.Header().Set("X-Pubkeyd-Stale", "true")
+	}
+}
+
+func getGithubName(w http.ResponseWriter, r *http.Request) {
+	user, tenant, err := requestedUser(r)
 	w.Header().Set("Content-Type", "text/plain")
-	if ok {
-		log.Infof("Found user %s with github name %s", params["id"], githubName)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404 user not found\n"))
+		countGithubNameRequest("", "404", "GET")
+		return
+	}
+	refreshMutex.RLock()
+	u, ok := users[user]
+	refreshMutex.RUnlock()
+	if ok && u.GithubName != "" {
+		log.Infof("Found user %s with github name %s", displayUser(user), u.GithubName)
 		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(githubName + "\n"))
-		metricGithubNameRequestsTotal.WithLabelValues("200", "GET").Inc()
+		w.Write([]byte(u.GithubName + "\n"))
+		countGithubNameRequest(tenant, "200", "GET")
 		return
 	}
-	log.Errorf("User %s not found", params["id"])
+	log.Errorf("User %s not found", displayUser(user))
 	w.WriteHeader(http.StatusNotFound)
 	w.Write([]byte("404 user not found\n"))
-	metricGithubNameRequestsTotal.WithLabelValues("404", "GET").Inc()
+	countGithubNameRequest(tenant, "404", "GET")
 }
 
 func getHealth(w http.ResponseWriter, r *http.Request) {
 	log.Debug("Returning health status")
+	refreshMutex.RLock()
+	stale := usersStale
+	refreshMutex.RUnlock()
 	w.Header().Set("Content-Type", "text/plain")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("ok\n"))
-}
-
-func getGithubUsers(onelogin onelogin.OneLogin) (map[string]string, error) {
-	log.Info("Updating users from OneLogin")
-	githubUsers := make(map[string]string)
-	filter := make(map[string]string)
-	oneLoginUsers, err := onelogin.Get_Users(filter)
-	if err != nil {
-		return githubUsers, fmt.Errorf("Failed to get users: %v", err)
-	}
-	for _, user := range *oneLoginUsers {
-		if githubName, ok := user.Custom_attributes["githubname"]; ok {
-			if githubName != "" && user.Status == 1 {
-				log.Debugf("Setting github name for user %s to %s\n", user.Username, githubName)
-				githubUsers[user.Username] = githubName
-			}
-		}
+	if stale {
+		w.Write([]byte("stale\n"))
+		return
 	}
-	return githubUsers, nil
+	w.Write([]byte("ok\n"))
 }
 
 func flagFromEnv(envVar string) string {
@@ -250,6 +914,8 @@ func flagFromEnv(envVar string) string {
 		switch envVar {
 		case "SHARD":
 			return "us"
+		case "PROVIDER":
+			return "onelogin"
 		}
 	}
 	return envValue
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SCIM 2.0 (RFC 7643, RFC 7644) Users endpoint that lets an identity
+// provider push user changes instead of waiting for the next refresh.
+const (
+	scimUserSchema        = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimListSchema        = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema       = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimPubkeydSchema     = "urn:ietf:params:scim:schemas:extension:pubkeyd:2.0:User"
+	scimContentType       = "application/scim+json"
+	scimDefaultGithubAttr = scimPubkeydSchema + ":githubName"
+)
+
+var (
+	scimUserNameFilter      = regexp.MustCompile(`(?i)^\s*userName\s+eq\s+"([^"]*)"\s*$`)
+	metricSCIMRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubkeyd_scim_requests_total",
+		Help: "Number of SCIM requests, partitioned by status code and HTTP method.",
+	}, []string{"code", "method"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricSCIMRequestsTotal)
+}
+
+type scimUser struct {
+	ID           string    `json:"id"`
+	ExternalID   string    `json:"external_id,omitempty"`
+	UserName     string    `json:"user_name"`
+	GithubName   string    `json:"github,omitempty"`
+	Active       bool      `json:"active"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// SCIMServer keeps the users provisioned through SCIM. It is an identity
+// provider layered over the polled one, so that refreshes keep the SCIM
+// users, and applies every change right away through that layering.
+type SCIMServer struct {
+	// bearer token the identity provider authenticates with
+	Token string
+	// attribute holding the github name, either a top level attribute or
+	// a fully qualified extension attribute like scimDefaultGithubAttr
+	GithubAttr string
+	// JSON file the SCIM users are persisted in, none if empty
+	Path string
+
+	mutex     sync.Mutex
+	scimUsers map[string]*scimUser
+}
+
+// NewSCIMServer creates a SCIM server that authenticates requests with token
+// and continues with the SCIM users persisted at path
+func NewSCIMServer(token string, githubAttr string, path string) (*SCIMServer, error) {
+	s := &SCIMServer{
+		Token:      token,
+		GithubAttr: githubAttr,
+		Path:       path,
+		scimUsers:  make(map[string]*scimUser),
+	}
+	if path == "" {
+		return s, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, &s.scimUsers); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %v", path, err)
+	}
+	log.Infof("Loaded %d SCIM users from %s", len(s.scimUsers), path)
+	return s, nil
+}
+
+// Users returns the active SCIM users that have a github name set
+func (s *SCIMServer) Users() (map[string]User, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	githubUsers := make(map[string]User)
+	for _, user := range s.scimUsers {
+		if u, ok := user.user(); ok {
+			githubUsers[user.UserName] = u
+		}
+	}
+	return githubUsers, nil
+}
+
+// user converts a SCIM user, it reports false for inactive users and users
+// without github name
+func (user *scimUser) user() (User, bool) {
+	if !user.Active || user.GithubName == "" {
+		return User{}, false
+	}
+	return newUser(user.GithubName), true
+}
+
+// Register adds the SCIM routes to router
+func (s *SCIMServer) Register(router *mux.Router) {
+	scim := router.PathPrefix("/scim/v2").Subrouter()
+	scim.Use(s.authenticate)
+	scim.HandleFunc("/Users", s.listUsers).Methods("GET")
+	scim.HandleFunc("/Users", s.createUser).Methods("POST")
+	scim.HandleFunc("/Users/{id}", s.getUser).Methods("GET")
+	scim.HandleFunc("/Users/{id}", s.replaceUser).Methods("PUT")
+	scim.HandleFunc("/Users/{id}", s.patchUser).Methods("PATCH")
+	scim.HandleFunc("/Users/{id}", s.deleteUser).Methods("DELETE")
+}
+
+func (s *SCIMServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+			log.Errorf("Unauthorized SCIM request from %s", clientHost(r))
+			s.writeError(w, r, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *SCIMServer) listUsers(w http.ResponseWriter, r *http.Request) {
+	userName := ""
+	if filter := r.URL.Query().Get("filter"); filter != "" {
+		m := scimUserNameFilter.FindStringSubmatch(filter)
+		if m == nil {
+			s.writeError(w, r, http.StatusBadRequest, "only userName eq filters are supported")
+			return
+		}
+		userName = m[1]
+	}
+	resources := make([]map[string]interface{}, 0)
+	s.mutex.Lock()
+	for _, user := range s.scimUsers {
+		if userName == "" || strings.EqualFold(user.UserName, userName) {
+			resources = append(resources, s.resource(user))
+		}
+	}
+	s.mutex.Unlock()
+	s.write(w, r, http.StatusOK, map[string]interface{}{
+		"schemas":      []string{scimListSchema},
+		"totalResults": len(resources),
+		"startIndex":   1,
+		"itemsPerPage": len(resources),
+		"Resources":    resources,
+	})
+}
+
+func (s *SCIMServer) getUser(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user, ok := s.scimUsers[mux.Vars(r)["id"]]
+	if !ok {
+		s.writeError(w, r, http.StatusNotFound, "user not found")
+		return
+	}
+	s.write(w, r, http.StatusOK, s.resource(user))
+}
+
+func (s *SCIMServer) createUser(w http.ResponseWriter, r *http.Request) {
+	var attributes map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&attributes); err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	user := &scimUser{ID: newSCIMID(), Active: true, Created: time.Now()}
+	if err := s.apply(user, attributes); err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, existing := range s.scimUsers {
+		if strings.EqualFold(existing.UserName, user.UserName) {
+			s.writeError(w, r, http.StatusConflict, "userName already exists")
+			return
+		}
+	}
+	s.scimUsers[user.ID] = user
+	log.Infof("SCIM created user %s", user.UserName)
+	s.sync("", user)
+	s.write(w, r, http.StatusCreated, s.resource(user))
+}
+
+func (s *SCIMServer) replaceUser(w http.ResponseWriter, r *http.Request) {
+	var attributes map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&attributes); err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user, ok := s.scimUsers[mux.Vars(r)["id"]]
+	if !ok {
+		s.writeError(w, r, http.StatusNotFound, "user not found")
+		return
+	}
+	replaced := &scimUser{ID: user.ID, Active: true, Created: user.Created}
+	if err := s.apply(replaced, attributes); err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.scimUsers[user.ID] = replaced
+	log.Infof("SCIM replaced user %s", replaced.UserName)
+	s.sync(user.UserName, replaced)
+	s.write(w, r, http.StatusOK, s.resource(replaced))
+}
+
+func (s *SCIMServer) patchUser(w http.ResponseWriter, r *http.Request) {
+	var patch struct {
+		Operations []struct {
+			Op    string      `json:"op"`
+			Path  string      `json:"path"`
+			Value interface{} `json:"value"`
+		} `json:"Operations"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user, ok := s.scimUsers[mux.Vars(r)["id"]]
+	if !ok {
+		s.writeError(w, r, http.StatusNotFound, "user not found")
+		return
+	}
+	patched := *user
+	for _, operation := range patch.Operations {
+		var err error
+		switch strings.ToLower(operation.Op) {
+		case "add", "replace":
+			if operation.Path == "" {
+				attributes, ok := operation.Value.(map[string]interface{})
+				if !ok {
+					err = fmt.Errorf("value of %s operation without path must be an object", operation.Op)
+				} else {
+					err = s.apply(&patched, attributes)
+				}
+			} else {
+				err = s.set(&patched, operation.Path, operation.Value)
+			}
+		case "remove":
+			err = s.set(&patched, operation.Path, nil)
+		default:
+			err = fmt.Errorf("unsupported patch operation %s", operation.Op)
+		}
+		if err != nil {
+			s.writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	s.scimUsers[user.ID] = &patched
+	log.Infof("SCIM patched user %s", patched.UserName)
+	s.sync(user.UserName, &patched)
+	s.write(w, r, http.StatusOK, s.resource(&patched))
+}
+
+func (s *SCIMServer) deleteUser(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user, ok := s.scimUsers[mux.Vars(r)["id"]]
+	if !ok {
+		s.writeError(w, r, http.StatusNotFound, "user not found")
+		return
+	}
+	delete(s.scimUsers, user.ID)
+	log.Infof("SCIM deleted user %s", user.UserName)
+	s.save()
+	revokeUser(s, user.UserName)
+	w.WriteHeader(http.StatusNoContent)
+	metricSCIMRequestsTotal.WithLabelValues("204", r.Method).Inc()
+}
+
+// sync persists a changed SCIM user and applies it to the users. Inactive
+// users are revoked in all identity providers, not just in SCIM.
+func (s *SCIMServer) sync(previousUserName string, user *scimUser) {
+	user.LastModified = time.Now()
+	s.save()
+	if previousUserName != "" && previousUserName != user.UserName {
+		updateUser(s, previousUserName, User{}, false)
+	}
+	if !user.Active {
+		revokeUser(s, user.UserName)
+		return
+	}
+	unrevokeUser(user.UserName)
+	u, ok := user.user()
+	updateUser(s, user.UserName, u, ok)
+}
+
+// save writes the SCIM users to Path, it must be called with the mutex held
+func (s *SCIMServer) save() {
+	if s.Path == "" {
+		return
+	}
+	data, err := json.Marshal(s.scimUsers)
+	if err != nil {
+		log.Errorf("Failed to encode SCIM users: %v", err)
+		return
+	}
+	if err := writeFileAtomic(s.Path, data); err != nil {
+		log.Error(err)
+	}
+}
+
+// apply sets all known attributes of a SCIM resource on user
+func (s *SCIMServer) apply(user *scimUser, attributes map[string]interface{}) error {
+	for name, value := range attributes {
+		if name == "schemas" || name == "id" || name == "meta" {
+			continue
+		}
+		if extension, ok := value.(map[string]interface{}); ok && strings.HasPrefix(name, "urn:") {
+			for extensionName, extensionValue := range extension {
+				if err := s.set(user, name+":"+extensionName, extensionValue); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := s.set(user, name, value); err != nil {
+			return err
+		}
+	}
+	if user.UserName == "" {
+		return fmt.Errorf("userName is required")
+	}
+	if !validUsername(user.UserName) {
+		return fmt.Errorf("userName can't contain NUL")
+	}
+	return nil
+}
+
+// set updates the attribute at path, a nil value removes it
+func (s *SCIMServer) set(user *scimUser, path string, value interface{}) error {
+	str, _ := value.(string)
+	switch {
+	case strings.EqualFold(path, "userName"):
+		if str == "" {
+			return fmt.Errorf("userName is required")
+		}
+		user.UserName = str
+	case strings.EqualFold(path, "externalId"):
+		user.ExternalID = str
+	case strings.EqualFold(path, "active"):
+		// some providers send booleans as strings
+		switch v := value.(type) {
+		case bool:
+			user.Active = v
+		case string:
+			user.Active = strings.EqualFold(v, "true")
+		case nil:
+			user.Active = false
+		default:
+			return fmt.Errorf("invalid value for active")
+		}
+	case strings.EqualFold(path, s.GithubAttr):
+		user.GithubName = str
+	}
+	return nil
+}
+
+func (s *SCIMServer) resource(user *scimUser) map[string]interface{} {
+	resource := map[string]interface{}{
+		"schemas":  []string{scimUserSchema},
+		"id":       user.ID,
+		"userName": user.UserName,
+		"active":   user.Active,
+		"meta": map[string]interface{}{
+			"resourceType": "User",
+			"created":      user.Created.Format(time.RFC3339),
+			"lastModified": user.LastModified.Format(time.RFC3339),
+			"location":     "/scim/v2/Users/" + user.ID,
+		},
+	}
+	if user.ExternalID != "" {
+		resource["externalId"] = user.ExternalID
+	}
+	if i := strings.LastIndex(s.GithubAttr, ":"); i != -1 {
+		schema := s.GithubAttr[:i]
+		resource["schemas"] = []string{scimUserSchema, schema}
+		resource[schema] = map[string]interface{}{s.GithubAttr[i+1:]: user.GithubName}
+	} else {
+		resource[s.GithubAttr] = user.GithubName
+	}
+	return resource
+}
+
+func (s *SCIMServer) write(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Set("Content-Type", scimContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+	metricSCIMRequestsTotal.WithLabelValues(fmt.Sprintf("%d", status), r.Method).Inc()
+}
+
+func (s *SCIMServer) writeError(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	s.write(w, r, status, map[string]interface{}{
+		"schemas": []string{scimErrorSchema},
+		"status":  fmt.Sprintf("%d", status),
+		"detail":  detail,
+	})
+}
+
+func newSCIMID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/patrickmn/go-cache"
+)
+
+// staticProvider is an identity provider with fixed users
+type staticProvider struct {
+	users map[string]User
+	err   error
+}
+
+func (p *staticProvider) Users() (map[string]User, error) {
+	users := make(map[string]User)
+	for username, u := range p.users {
+		users[username] = u
+	}
+	return users, p.err
+}
+
+func scimRequest(t *testing.T, url string, method string, body string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestSCIMUsersSurviveRefreshAndRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pubkeyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json.scim")
+	pubkeyCache = cache.New(time.Minute, time.Minute)
+	users = nil
+	polled := &staticProvider{users: map[string]User{"bob": newUser("bob")}}
+	scim, err := NewSCIMServer("token", scimDefaultGithubAttr, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp = &LayeredProvider{Layers: []IdentityProvider{polled, scim}}
+	syncGuard = nil
+	if err := refreshOneLoginUsers(); err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	scim.Register(router)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	resp := scimRequest(t, server.URL+"/scim/v2/Users", "POST",
+		`{"userName":"alice","`+scimPubkeydSchema+`":{"githubName":"alice-gh"}}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create returned %s", resp.Status)
+	}
+	if err := refreshOneLoginUsers(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]User{"alice": newUser("alice-gh"), "bob": newUser("bob")}
+	if !reflect.DeepEqual(users, want) {
+		t.Errorf("users after refresh are %v, want %v", users, want)
+	}
+
+	restarted, err := NewSCIMServer("token", scimDefaultGithubAttr, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scimUsers, _ := restarted.Users()
+	if !reflect.DeepEqual(scimUsers, map[string]User{"alice": newUser("alice-gh")}) {
+		t.Errorf("SCIM users after restart are %v", scimUsers)
+	}
+
+	// a SCIM user overrides the polled user of the same name
+	resp = scimRequest(t, server.URL+"/scim/v2/Users", "POST",
+		`{"userName":"bob","`+scimPubkeydSchema+`":{"githubName":"bob-scim"}}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create returned %s", resp.Status)
+	}
+	if users["bob"].GithubName != "bob-scim" {
+		t.Errorf("bob has github name %s, want bob-scim", users["bob"].GithubName)
+	}
+}
+
+// scimUserID returns the SCIM id of username
+func scimUserID(s *SCIMServer, username string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for id, user := range s.scimUsers {
+		if user.UserName == username {
+			return id
+		}
+	}
+	return ""
+}
+
+func TestSCIMDeprovisioningRevokesPolledUsers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pubkeyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pubkeyCache = cache.New(time.Minute, time.Minute)
+	users = nil
+	syncGuard = nil
+	polled := &staticProvider{users: map[string]User{"bob": newUser("bob"), "carol": newUser("carol")}}
+	scim, err := NewSCIMServer("token", scimDefaultGithubAttr, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokedPath := filepath.Join(dir, "state.json.revoked")
+	layered := &LayeredProvider{Layers: []IdentityProvider{polled, scim}, RevokedPath: revokedPath}
+	idp = layered
+	if err := refreshOneLoginUsers(); err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	scim.Register(router)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	for _, username := range []string{"bob", "carol"} {
+		resp := scimRequest(t, server.URL+"/scim/v2/Users", "POST",
+			`{"userName":"`+username+`","`+scimPubkeydSchema+`":{"githubName":"`+username+`-scim"}}`)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("create returned %s", resp.Status)
+		}
+	}
+	// a SCIM delete and a deactivation revoke the users although the
+	// polled provider still returns them
+	resp := scimRequest(t, server.URL+"/scim/v2/Users/"+scimUserID(scim, "bob"), "DELETE", "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete returned %s", resp.Status)
+	}
+	resp = scimRequest(t, server.URL+"/scim/v2/Users/"+scimUserID(scim, "carol"), "PATCH",
+		`{"Operations":[{"op":"replace","path":"active","value":false}]}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("patch returned %s", resp.Status)
+	}
+	if len(users) != 0 {
+		t.Errorf("users after deprovisioning are %v", users)
+	}
+	if err := refreshOneLoginUsers(); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 0 {
+		t.Errorf("users after refresh are %v", users)
+	}
+
+	// the revocation survives restarts
+	restarted := &LayeredProvider{Layers: []IdentityProvider{polled, scim}, RevokedPath: revokedPath}
+	if err := restarted.loadRevoked(); err != nil {
+		t.Fatal(err)
+	}
+	if merged, _ := restarted.Users(); len(merged) != 0 {
+		t.Errorf("users after restart are %v", merged)
+	}
+
+	// once the polled provider no longer returns bob he may come back
+	polled.users = map[string]User{"carol": newUser("carol")}
+	if err := refreshOneLoginUsers(); err != nil {
+		t.Fatal(err)
+	}
+	polled.users["bob"] = newUser("bob")
+	if err := refreshOneLoginUsers(); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]User{"bob": newUser("bob")}; !reflect.DeepEqual(users, want) {
+		t.Errorf("users after bob left and rejoined are %v, want %v", users, want)
+	}
+
+	// reactivating carol through SCIM ends her revocation
+	resp = scimRequest(t, server.URL+"/scim/v2/Users/"+scimUserID(scim, "carol"), "PATCH",
+		`{"Operations":[{"op":"replace","path":"active","value":true}]}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("patch returned %s", resp.Status)
+	}
+	if users["carol"].GithubName != "carol-scim" {
+		t.Errorf("carol has github name %s after reactivation, want carol-scim", users["carol"].GithubName)
+	}
+}
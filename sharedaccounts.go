@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// number of members of a shared account whose keys are fetched at once
+const sharedAccountWorkers = 8
+
+// SharedAccounts maps shared local accounts to the roles or groups whose
+// members may log in to them:
+//
+//	{
+//	  "deploy": ["ops", "release"],
+//	  "ubuntu": ["admins"]
+//	}
+type SharedAccounts map[string][]string
+
+func loadSharedAccounts(path string) (SharedAccounts, error) {
+	accounts := make(SharedAccounts)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return accounts, fmt.Errorf("Failed to read %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return accounts, fmt.Errorf("Failed to parse %s: %v", path, err)
+	}
+	return accounts, nil
+}
+
+// members returns the users of the main identity provider that are members
+// of one of the roles of a shared account and entitled to log in to the
+// requesting host
+func (s SharedAccounts) members(account string, users map[string]User, entitled func(User) bool) map[string]User {
+	roles := make(map[string]bool)
+	for _, role := range s[account] {
+		roles[role] = true
+	}
+	members := make(map[string]User)
+	for username, u := range users {
+		if !entitled(u) || userTenant(username) != "" {
+			continue
+		}
+		for _, role := range u.Roles {
+			if roles[role] {
+				members[username] = u
+				break
+			}
+		}
+	}
+	return members
+}
+
+// sharedAuthorizedKeys returns the de-duplicated keys of the members of a
+// shared account with their comments replaced by the names of the users
+// owning them. The keys of up to sharedAccountWorkers members are fetched at
+// once. Members whose keys can't be retrieved are left out, it fails
+// only if none of the members keys could be retrieved. The cache result is
+// stale if the keys of any member are, a miss if any members keys were
+// fetched and fresh otherwise.
+func sharedAuthorizedKeys(account string, members map[string]User) (string, string, error) {
+	var names []string
+	for member := range members {
+		names = append(names, member)
+	}
+	sort.Strings(names)
+	type memberKeys struct {
+		keys   string
+		result string
+		err    error
+	}
+	var fetchedMutex sync.Mutex
+	fetched := make(map[string]memberKeys, len(names))
+	forEachUser(names, sharedAccountWorkers, func(member string) {
+		keys, result, err := cachedAuthorizedKeys(member, members[member])
+		fetchedMutex.Lock()
+		fetched[member] = memberKeys{keys, result, err}
+		fetchedMutex.Unlock()
+	})
+
+	var order []string
+	keys := make(map[string]ssh.PublicKey)
+	owners := make(map[string][]string)
+	failed := 0
+	result := cacheFresh
+	for _, member := range names {
+		authorizedKeys, memberResult, err := fetched[member].keys, fetched[member].result, fetched[member].err
+		if memberResult == cacheStale || (memberResult == cacheMiss && result != cacheStale) {
+			result = memberResult
+		}
+		if err != nil {
+			log.Errorf("Leaving out keys of user %s from shared account %s: %v", member, account, err)
+			failed++
+			continue
+		}
+		rest := []byte(authorizedKeys)
+		for len(rest) > 0 {
+			key, _, _, next, err := ssh.ParseAuthorizedKey(rest)
+			if err != nil {
+				break
+			}
+			rest = next
+			id := string(key.Marshal())
+			if _, ok := keys[id]; !ok {
+				order = append(order, id)
+				keys[id] = key
+			}
+			if n := len(owners[id]); n == 0 || owners[id][n-1] != member {
+				owners[id] = append(owners[id], member)
+			}
+		}
+	}
+	if failed > 0 && failed == len(names) {
+		return "", cacheError, fmt.Errorf("Failed to retrieve keys of all %d members of shared account %s", failed, account)
+	}
+	bundle := ""
+	for _, id := range order {
+		bundle += strings.TrimSpace(string(ssh.MarshalAuthorizedKey(keys[id]))) + " " + strings.Join(owners[id], ",") + "\n"
+	}
+	return bundle, result, nil
+}
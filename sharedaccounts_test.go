@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+func TestSharedAccountMembers(t *testing.T) {
+	accounts := SharedAccounts{"deploy": {"ops", "release"}}
+	users := map[string]User{
+		"alice": {Roles: []string{"ops"}},
+		"bob":   {Roles: []string{"engineering", "release"}},
+		"carol": {Roles: []string{"engineering"}},
+	}
+	all := func(User) bool { return true }
+	for _, test := range []struct {
+		account  string
+		entitled func(User) bool
+		want     []string
+	}{
+		{"deploy", all, []string{"alice", "bob"}},
+		{"deploy", func(u User) bool { return u.Roles[0] == "engineering" }, []string{"bob"}},
+		{"ubuntu", all, nil},
+	} {
+		var got []string
+		for member := range accounts.members(test.account, users, test.entitled) {
+			got = append(got, member)
+		}
+		if len(got) > 1 && got[0] > got[1] {
+			got[0], got[1] = got[1], got[0]
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("account %s: got members %v, want %v", test.account, got, test.want)
+		}
+	}
+}
+
+func TestSharedAuthorizedKeys(t *testing.T) {
+	otherKey := strings.Join(strings.Fields(testOtherKey)[:2], " ")
+	thirdKey := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIJdD7qj5xVbH8yS2r4fQk2n0lRw1nGz3eC9vXb6tMpYa"
+	source := &fakeKeySource{keys: map[string]string{
+		"alice": testGithubKey + " alice@laptop\n" + otherKey + "\n",
+		"bob":   otherKey + " bob@desktop\n" + thirdKey + "\n",
+	}}
+	keySources["fake"] = source
+	defer delete(keySources, "fake")
+	pubkeyCache = cache.New(time.Minute, time.Minute)
+	members := map[string]User{
+		"alice": {Accounts: map[string]string{"fake": "alice"}},
+		"bob":   {Accounts: map[string]string{"fake": "bob"}},
+		"carol": {Accounts: map[string]string{"fake": "carol"}},
+	}
+
+	want := testGithubKey + " alice\n" + otherKey + " alice,bob\n" + thirdKey + " bob\n"
+	for _, wantResult := range []string{cacheMiss, cacheFresh} {
+		keys, result, err := sharedAuthorizedKeys("deploy", members)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys != want || result != wantResult {
+			t.Errorf("got keys %q, %s, want %q, %s", keys, result, want, wantResult)
+		}
+	}
+	if _, _, err := sharedAuthorizedKeys("deploy", map[string]User{"carol": members["carol"]}); err == nil {
+		t.Error("expected an error when the keys of no member could be retrieved")
+	}
+
+	// members are fetched concurrently, but by no more than sharedAccountWorkers
+	source.delay = 20 * time.Millisecond
+	many := make(map[string]User)
+	for i := 0; i < 3*sharedAccountWorkers; i++ {
+		name := fmt.Sprintf("user%d", i)
+		source.keys[name] = testGithubKey + "\n"
+		many[name] = User{Accounts: map[string]string{"fake": name}}
+	}
+	if _, _, err := sharedAuthorizedKeys("deploy", many); err != nil {
+		t.Fatal(err)
+	}
+	if source.maxInFlight < 2 || source.maxInFlight > sharedAccountWorkers {
+		t.Errorf("fetched the keys of %d members at once, want 2 to %d", source.maxInFlight, sharedAccountWorkers)
+	}
+}
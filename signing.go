@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"pubkeyd/sshsig"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/ssh"
+)
+
+// ResponseSigner signs authorized_keys responses with an Ed25519 key so
+// that hosts can detect keys injected between them and pubkeyd
+type ResponseSigner struct {
+	Signer ssh.Signer
+}
+
+// NewResponseSigner loads the Ed25519 private key from path
+func NewResponseSigner(path string) (*ResponseSigner, error) {
+	pemBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read signing key: %v", err)
+	}
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse signing key: %v", err)
+	}
+	if signer.PublicKey().Type() != ssh.KeyAlgoED25519 {
+		return nil, fmt.Errorf("Signing key is %s, not ssh-ed25519", signer.PublicKey().Type())
+	}
+	return &ResponseSigner{Signer: signer}, nil
+}
+
+// Register adds the route publishing the public key to router
+func (s *ResponseSigner) Register(router *mux.Router) {
+	router.HandleFunc("/signing_key", s.getPublicKey).Methods("GET")
+}
+
+func (s *ResponseSigner) getPublicKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	w.Write(ssh.MarshalAuthorizedKey(s.Signer.PublicKey()))
+}
+
+// sign adds the signature headers for body to w, it must be called before
+// the header is written
+func (s *ResponseSigner) sign(w http.ResponseWriter, r *http.Request, user string, body []byte) {
+	if s == nil {
+		return
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := r.Header.Get(sshsig.NonceHeader)
+	signature, err := sshsig.SignBlob(s.Signer, sshsig.ResponseNamespace, sshsig.SignedResponse(user, timestamp, nonce, body))
+	if err != nil {
+		log.Errorf("Failed to sign authorized_keys of user %s: %v", user, err)
+		return
+	}
+	w.Header().Set(sshsig.TimestampHeader, timestamp)
+	w.Header().Set(sshsig.NonceHeader, nonce)
+	w.Header().Set(sshsig.SignatureHeader, base64.StdEncoding.EncodeToString(signature))
+}
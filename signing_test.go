@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"pubkeyd/sshsig"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestResponseSigner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pubkeyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(ecdsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewResponseSigner(writeCAKey(t, dir, "EC PRIVATE KEY", der)); err == nil {
+		t.Error("accepted an ECDSA signing key")
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ResponseSigner{Signer: signer}
+	body := []byte(testGithubKey + "\n")
+	r := httptest.NewRequest("GET", "/authorized_keys/alice", nil)
+	r.Header.Set(sshsig.NonceHeader, "c0ffee")
+	w := httptest.NewRecorder()
+	s.sign(w, r, "alice", body)
+	if err := sshsig.VerifyResponse(signer.PublicKey(), "alice", "c0ffee", time.Minute, w.Header(), body); err != nil {
+		t.Error(err)
+	}
+	if err := sshsig.VerifyResponse(signer.PublicKey(), "alice", "", time.Minute, w.Header(), body); err == nil {
+		t.Error("verified a response to another nonce")
+	}
+
+	var none *ResponseSigner
+	w = httptest.NewRecorder()
+	none.sign(w, r, "alice", body)
+	if len(w.Header()) != 0 {
+		t.Errorf("got headers %v without a signer", w.Header())
+	}
+}
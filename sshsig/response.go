@@ -0,0 +1,67 @@
+package sshsig
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ResponseNamespace is the SSHSIG namespace of signed authorized_keys
+// responses
+const ResponseNamespace = "pubkeyd-authorized-keys"
+
+// Headers of signed responses. The signature is the base64 encoded binary
+// SSHSIG signature over SignedResponse.
+const (
+	SignatureHeader = "X-Pubkeyd-Signature"
+	TimestampHeader = "X-Pubkeyd-Timestamp"
+	// a random value the client sends and gets back signed, so that old
+	// responses can't be replayed to it
+	NonceHeader = "X-Pubkeyd-Nonce"
+)
+
+// SignedResponse is the message signed for a response: the requested user,
+// the unix timestamp and the clients nonce on a line each, followed by the
+// body
+func SignedResponse(user string, timestamp string, nonce string, body []byte) []byte {
+	return append([]byte(user+"\n"+timestamp+"\n"+nonce+"\n"), body...)
+}
+
+// VerifyResponse checks that the response headers carry a signature of
+// publicKey over the body for user and nonce that isn't older than maxAge
+func VerifyResponse(publicKey ssh.PublicKey, user string, nonce string, maxAge time.Duration, header http.Header, body []byte) error {
+	encoded := header.Get(SignatureHeader)
+	if encoded == "" {
+		return fmt.Errorf("response is not signed")
+	}
+	timestamp := header.Get(TimestampHeader)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q", timestamp)
+	}
+	if age := time.Since(time.Unix(unix, 0)); age > maxAge || age < -maxAge {
+		return fmt.Errorf("response timestamp %s is off by %s", time.Unix(unix, 0).Format(time.RFC3339), age)
+	}
+	if header.Get(NonceHeader) != nonce {
+		return fmt.Errorf("response is for another request")
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("invalid signature")
+	}
+	signature, err := ParseBlob(data)
+	if err != nil {
+		return err
+	}
+	if string(signature.PublicKey.Marshal()) != string(publicKey.Marshal()) {
+		return fmt.Errorf("signed by unknown key")
+	}
+	if err := signature.Verify(ResponseNamespace, SignedResponse(user, timestamp, nonce, body)); err != nil {
+		return fmt.Errorf("signature verification failed: %v", err)
+	}
+	return nil
+}
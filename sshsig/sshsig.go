@@ -0,0 +1,150 @@
+// Package sshsig creates and verifies signatures in the OpenSSH SSHSIG format
+// as created by ssh-keygen -Y sign, see PROTOCOL.sshsig in the OpenSSH
+// sources. It is shared by pubkeyd and pubkeyd-verify.
+package sshsig
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/pem"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// magic preamble, version and armor type of SSHSIG signatures
+const (
+	Magic   = "SSHSIG"
+	Version = 1
+	PEMType = "SSH SIGNATURE"
+)
+
+type blob struct {
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Signature     []byte
+}
+
+type signedData struct {
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Hash          []byte
+}
+
+// Signature is a parsed SSHSIG signature
+type Signature struct {
+	PublicKey     ssh.PublicKey
+	Namespace     string
+	HashAlgorithm string
+	Signature     *ssh.Signature
+}
+
+// Parse parses an armored -----BEGIN SSH SIGNATURE----- block
+func Parse(armored []byte) (*Signature, error) {
+	block, _ := pem.Decode(armored)
+	if block == nil || block.Type != PEMType {
+		return nil, fmt.Errorf("no SSH SIGNATURE block found")
+	}
+	return ParseBlob(block.Bytes)
+}
+
+// ParseBlob parses the binary SSHSIG signature inside the armor
+func ParseBlob(data []byte) (*Signature, error) {
+	if len(data) < len(Magic) || string(data[:len(Magic)]) != Magic {
+		return nil, fmt.Errorf("invalid SSHSIG magic")
+	}
+	var b blob
+	if err := ssh.Unmarshal(data[len(Magic):], &b); err != nil {
+		return nil, fmt.Errorf("invalid SSHSIG: %v", err)
+	}
+	if b.Version != Version {
+		return nil, fmt.Errorf("unsupported SSHSIG version %d", b.Version)
+	}
+	publicKey, err := ssh.ParsePublicKey(b.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSHSIG public key: %v", err)
+	}
+	signature := &ssh.Signature{}
+	if err := ssh.Unmarshal(b.Signature, signature); err != nil {
+		return nil, fmt.Errorf("invalid SSHSIG signature: %v", err)
+	}
+	return &Signature{
+		PublicKey:     publicKey,
+		Namespace:     b.Namespace,
+		HashAlgorithm: b.HashAlgorithm,
+		Signature:     signature,
+	}, nil
+}
+
+// Verify checks that the signature was made over message in namespace
+func (s *Signature) Verify(namespace string, message []byte) error {
+	if s.Namespace != namespace {
+		return fmt.Errorf("signature namespace %q, expected %q", s.Namespace, namespace)
+	}
+	var h hash.Hash
+	switch s.HashAlgorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return fmt.Errorf("unsupported SSHSIG hash algorithm %s", s.HashAlgorithm)
+	}
+	h.Write(message)
+	return verify(s.PublicKey, signedMessage(namespace, s.HashAlgorithm, h.Sum(nil)), s.Signature)
+}
+
+// SignBlob signs message in namespace and returns the binary SSHSIG
+// signature
+func SignBlob(signer ssh.Signer, namespace string, message []byte) ([]byte, error) {
+	h := sha512.Sum512(message)
+	signature, err := signer.Sign(rand.Reader, signedMessage(namespace, "sha512", h[:]))
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(Magic), ssh.Marshal(blob{
+		Version:       Version,
+		PublicKey:     signer.PublicKey().Marshal(),
+		Namespace:     namespace,
+		HashAlgorithm: "sha512",
+		Signature:     ssh.Marshal(signature),
+	})...), nil
+}
+
+// signedMessage returns the data an SSHSIG signature is made over
+func signedMessage(namespace string, hashAlgorithm string, hash []byte) []byte {
+	return append([]byte(Magic), ssh.Marshal(signedData{
+		Namespace:     namespace,
+		HashAlgorithm: hashAlgorithm,
+		Hash:          hash,
+	})...)
+}
+
+// verify verifies sig over data, adding the SHA-2 RSA signature algorithms
+// the vendored ssh package does not know about yet
+func verify(key ssh.PublicKey, data []byte, sig *ssh.Signature) error {
+	var hashFunc crypto.Hash
+	switch sig.Format {
+	case "rsa-sha2-256":
+		hashFunc = crypto.SHA256
+	case "rsa-sha2-512":
+		hashFunc = crypto.SHA512
+	default:
+		return key.Verify(data, sig)
+	}
+	cryptoKey, ok := key.(ssh.CryptoPublicKey)
+	if !ok || key.Type() != ssh.KeyAlgoRSA {
+		return fmt.Errorf("signature type %s for key type %s", sig.Format, key.Type())
+	}
+	h := hashFunc.New()
+	h.Write(data)
+	return rsa.VerifyPKCS1v15(cryptoKey.CryptoPublicKey().(*rsa.PublicKey), hashFunc, h.Sum(nil), sig.Blob)
+}
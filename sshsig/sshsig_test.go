@@ -0,0 +1,181 @@
+package sshsig
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestSignVerify(t *testing.T) {
+	signer := newSigner(t)
+	data, err := SignBlob(signer, "file", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := Parse(pem.EncodeToMemory(&pem.Block{Type: PEMType, Bytes: data}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(signature.PublicKey.Marshal()) != string(signer.PublicKey().Marshal()) || signature.HashAlgorithm != "sha512" {
+		t.Errorf("parsed %+v", signature)
+	}
+	if err := signature.Verify("file", []byte("hello")); err != nil {
+		t.Error(err)
+	}
+	if err := signature.Verify("file", []byte("hello!")); err == nil {
+		t.Error("verified another message")
+	}
+	if err := signature.Verify("email", []byte("hello")); err == nil {
+		t.Error("verified in another namespace")
+	}
+
+	for _, invalid := range [][]byte{nil, []byte("SSHSIX"), data[:len(data)-1], append([]byte(Magic), ssh.Marshal(blob{Version: 2})...)} {
+		if _, err := ParseBlob(invalid); err == nil {
+			t.Errorf("parsed %q", invalid)
+		}
+	}
+	if _, err := Parse(pem.EncodeToMemory(&pem.Block{Type: "SSH SIGNATURES", Bytes: data})); err == nil {
+		t.Error("parsed another armor type")
+	}
+}
+
+func TestVerifyRSASHA2(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messageHash := sha256.Sum256([]byte("hello"))
+	for _, test := range []struct {
+		format string
+		hash   crypto.Hash
+	}{
+		{"rsa-sha2-256", crypto.SHA256},
+		{"rsa-sha2-512", crypto.SHA512},
+	} {
+		h := test.hash.New()
+		h.Write(signedMessage("file", "sha256", messageHash[:]))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, test.hash, h.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature := &Signature{PublicKey: publicKey, Namespace: "file", HashAlgorithm: "sha256", Signature: &ssh.Signature{Format: test.format, Blob: sig}}
+		if err := signature.Verify("file", []byte("hello")); err != nil {
+			t.Errorf("%s: %v", test.format, err)
+		}
+		if err := signature.Verify("file", []byte("hello!")); err == nil {
+			t.Errorf("%s: verified another message", test.format)
+		}
+	}
+
+	// rsa-sha2 signatures are only accepted from RSA keys
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaPublicKey, err := ssh.NewPublicKey(&ecdsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := &Signature{PublicKey: ecdsaPublicKey, Namespace: "file", HashAlgorithm: "sha256", Signature: &ssh.Signature{Format: "rsa-sha2-256"}}
+	if err := signature.Verify("file", []byte("hello")); err == nil || !strings.Contains(err.Error(), "key type") {
+		t.Errorf("expected an rsa-sha2 signature of an ECDSA key to be refused, got %v", err)
+	}
+}
+
+// signResponse returns the headers pubkeyd sends with a response signed
+// at timestamp
+func signResponse(t *testing.T, signer ssh.Signer, namespace string, user string, timestamp time.Time, nonce string, body string) http.Header {
+	unix := strconv.FormatInt(timestamp.Unix(), 10)
+	signature, err := SignBlob(signer, namespace, SignedResponse(user, unix, nonce, []byte(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := make(http.Header)
+	header.Set(SignatureHeader, base64.StdEncoding.EncodeToString(signature))
+	header.Set(TimestampHeader, unix)
+	header.Set(NonceHeader, nonce)
+	return header
+}
+
+func TestVerifyResponse(t *testing.T) {
+	signer, other := newSigner(t), newSigner(t)
+	body := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\n"
+	now := time.Now()
+	valid := signResponse(t, signer, ResponseNamespace, "alice", now, "nonce1", body)
+	if err := VerifyResponse(signer.PublicKey(), "alice", "nonce1", time.Minute, valid, []byte(body)); err != nil {
+		t.Fatal(err)
+	}
+
+	unsigned := make(http.Header)
+	unsigned.Set(TimestampHeader, valid.Get(TimestampHeader))
+	unsigned.Set(NonceHeader, "nonce1")
+	garbled := signResponse(t, signer, ResponseNamespace, "alice", now, "nonce1", body)
+	garbled.Set(SignatureHeader, "not base64!")
+	sha512Hash := sha512.Sum512([]byte(body))
+	truncated := signResponse(t, signer, ResponseNamespace, "alice", now, "nonce1", body)
+	truncated.Set(SignatureHeader, base64.StdEncoding.EncodeToString(sha512Hash[:]))
+	for _, test := range []struct {
+		name   string
+		user   string
+		nonce  string
+		header http.Header
+		body   string
+	}{
+		{"unsigned", "alice", "nonce1", unsigned, body},
+		{"garbled signature", "alice", "nonce1", garbled, body},
+		{"not a signature", "alice", "nonce1", truncated, body},
+		{"tampered body", "alice", "nonce1", valid, body + "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHx2Ac5pU7N5Yc0eQyGDGNBv2W6ZrP8M6Ld0r0jDWrQp\n"},
+		{"other user", "bob", "nonce1", valid, body},
+		{"replayed", "alice", "nonce2", valid, body},
+		{"replayed with the new nonce", "alice", "nonce2", withHeader(valid, NonceHeader, "nonce2"), body},
+		{"timestamp changed", "alice", "nonce1", withHeader(valid, TimestampHeader, strconv.FormatInt(now.Unix()+1, 10)), body},
+		{"stale", "alice", "nonce1", signResponse(t, signer, ResponseNamespace, "alice", now.Add(-2*time.Minute), "nonce1", body), body},
+		{"future", "alice", "nonce1", signResponse(t, signer, ResponseNamespace, "alice", now.Add(2*time.Minute), "nonce1", body), body},
+		{"other key", "alice", "nonce1", signResponse(t, other, ResponseNamespace, "alice", now, "nonce1", body), body},
+		{"other namespace", "alice", "nonce1", signResponse(t, signer, "pubkeyd-ca", "alice", now, "nonce1", body), body},
+	} {
+		if err := VerifyResponse(signer.PublicKey(), test.user, test.nonce, time.Minute, test.header, []byte(test.body)); err == nil {
+			t.Errorf("%s: verified", test.name)
+		}
+	}
+}
+
+// withHeader returns a copy of header with name set to value
+func withHeader(header http.Header, name string, value string) http.Header {
+	copied := make(http.Header)
+	for key, values := range header {
+		copied[key] = values
+	}
+	copied.Set(name, value)
+	return copied
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var metricStale = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "pubkeyd_stale",
+	Help: "Whether the users are served from the state file because the identity provider is unavailable.",
+})
+
+func init() {
+	prometheus.MustRegister(metricStale)
+}
+
+// StateKeys are the keys of a user as last fetched
+type StateKeys struct {
+	Keys    string    `json:"keys"`
+	Fetched time.Time `json:"fetched"`
+}
+
+type stateFile struct {
+	Saved time.Time            `json:"saved"`
+	Users map[string]User      `json:"users"`
+	Keys  map[string]StateKeys `json:"keys"`
+}
+
+// State persists the users and their keys to a JSON file so that pubkeyd
+// can serve them after a restart while the identity provider or the key
+// sources are down
+type State struct {
+	Path string
+
+	mutex sync.Mutex
+	keys  map[string]StateKeys
+	dirty bool
+}
+
+// NewState returns the state stored at path, it is loaded with load
+func NewState(path string) *State {
+	return &State{Path: path, keys: make(map[string]StateKeys)}
+}
+
+// load reads the state file and seeds the key cache, fingerprint index and
+// key change notifier with its keys, it returns the users of the snapshot
+func (s *State) load() (map[string]User, error) {
+	data, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		log.Infof("No state file %s yet", s.Path)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %v", s.Path, err)
+	}
+	var state stateFile
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %v", s.Path, err)
+	}
+	s.mutex.Lock()
+	for user, keys := range state.Keys {
+		s.keys[user] = keys
+		pubkeyCache.Set(user, cachedKeys{Keys: keys.Keys, Fetched: keys.Fetched}, cache.DefaultExpiration)
+		fingerprintIndex.update(user, state.Users[user], keys.Keys)
+		keyChanges.seed(user, keys.Keys)
+	}
+	s.mutex.Unlock()
+	log.Infof("Loaded %d users and keys of %d users saved at %s from %s", len(state.Users), len(state.Keys), state.Saved.Format(time.RFC3339), s.Path)
+	return state.Users, nil
+}
+
+// setKeys records the freshly fetched keys of user
+func (s *State) setKeys(user string, keys string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	s.keys[user] = StateKeys{Keys: keys, Fetched: time.Now()}
+	s.dirty = true
+	s.mutex.Unlock()
+}
+
+// lastKeys returns the keys of user as last fetched
+func (s *State) lastKeys(user string) (StateKeys, bool) {
+	if s == nil {
+		return StateKeys{}, false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	keys, ok := s.keys[user]
+	return keys, ok
+}
+
+// forgetKeys drops the keys of user
+func (s *State) forgetKeys(user string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	delete(s.keys, user)
+	s.dirty = true
+	s.mutex.Unlock()
+}
+
+// touch marks the users as changed
+func (s *State) touch() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	s.dirty = true
+	s.mutex.Unlock()
+}
+
+// save writes the state file if anything changed since the last save. The
+// keys of users that are gone are dropped.
+func (s *State) save() error {
+	state := stateFile{Saved: time.Now(), Users: make(map[string]User), Keys: make(map[string]StateKeys)}
+	refreshMutex.RLock()
+	for user, u := range users {
+		state.Users[user] = u
+	}
+	refreshMutex.RUnlock()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	for user := range s.keys {
+		if _, ok := state.Users[user]; !ok {
+			delete(s.keys, user)
+			continue
+		}
+		state.Keys[user] = s.keys[user]
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("Failed to encode state: %v", err)
+	}
+	if err := writeFileAtomic(s.Path, data); err != nil {
+		return err
+	}
+	s.dirty = false
+	log.Debugf("Saved %d users and keys of %d users to %s", len(state.Users), len(state.Keys), s.Path)
+	return nil
+}
+
+// run saves the state every interval
+func (s *State) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.save(); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// writeFileAtomic replaces the file at path with data so that readers never
+// see a partially written file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return fmt.Errorf("Failed to write %s: %v", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Failed to write %s: %v", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Failed to write %s: %v", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("Failed to write %s: %v", path, err)
+	}
+	return nil
+}
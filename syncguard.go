@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	syncRefusedEvent = "sync_refused"
+	// removed users named in sync refused notifications
+	syncRefusedSample = 20
+)
+
+var (
+	metricSyncGuardBlocked = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "pubkeyd_sync_guard_blocked",
+		Help: "Whether the last users refresh was refused because it removed too many users.",
+	})
+	metricSyncGuardRefusalsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "pubkeyd_sync_guard_refusals_total",
+		Help: "Number of users refreshes refused because they removed too many users.",
+	})
+	metricSyncGuardOverridesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "pubkeyd_sync_guard_overrides_total",
+		Help: "Number of refused users refreshes accepted by an admin.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(metricSyncGuardBlocked)
+	prometheus.MustRegister(metricSyncGuardRefusalsTotal)
+	prometheus.MustRegister(metricSyncGuardOverridesTotal)
+}
+
+// SyncRefusedEvent is sent to the webhooks when the sync guard refuses a
+// refresh
+type SyncRefusedEvent struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Tenant   string    `json:"tenant,omitempty"`
+	Users    int       `json:"users"`
+	Proposed int       `json:"proposed"`
+	Removed  int       `json:"removed"`
+	// some of the removed users
+	Sample []string `json:"sample"`
+}
+
+func (e SyncRefusedEvent) subject() string {
+	return "refused users refresh" + tenantLabel(e.Tenant)
+}
+
+func (e SyncRefusedEvent) text() string {
+	return fmt.Sprintf("Refused users refresh%s that would remove %d of %d users, e.g. %s. Accept it with POST %s/accept if that is intended.",
+		tenantLabel(e.Tenant), e.Removed, e.Users, strings.Join(e.Sample, ", "), syncGuardPath(e.Tenant))
+}
+
+// SyncGuard refuses users refreshes that remove more than MaxRemovedPercent
+// percent or MaxRemovedUsers of the users, as happens when the identity
+// provider returns a truncated list, so that such an outage doesn't lock
+// everyone out. The previous users are kept until a refresh passes or an
+// admin accepts the refused one.
+type SyncGuard struct {
+	// 0 disables either limit
+	MaxRemovedPercent float64
+	MaxRemovedUsers   int
+	// refreshes removing at most this many users always pass, so that
+	// offboarding in small teams doesn't trip the percentage
+	MinRemovedUsers int
+	// tenant whose refreshes are checked, empty for the main identity
+	// provider
+	Tenant string
+
+	mutex     sync.Mutex
+	refused   map[string]User
+	refusedAt time.Time
+	removed   []string
+}
+
+// syncGuardStatus is returned by GET /sync_guard
+type syncGuardStatus struct {
+	Blocked   bool       `json:"blocked"`
+	RefusedAt *time.Time `json:"refused_at,omitempty"`
+	Users     int        `json:"users"`
+	Proposed  int        `json:"proposed,omitempty"`
+	Removed   []string   `json:"removed,omitempty"`
+}
+
+// check returns an error if replacing current with next removes too many
+// users, and remembers next for an admin to accept
+func (g *SyncGuard) check(current, next map[string]User) error {
+	if g == nil {
+		return nil
+	}
+	var removed []string
+	for user := range current {
+		if _, ok := next[user]; !ok {
+			removed = append(removed, user)
+		}
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	tooMany := len(removed) > g.MinRemovedUsers &&
+		((g.MaxRemovedUsers > 0 && len(removed) > g.MaxRemovedUsers) ||
+			(g.MaxRemovedPercent > 0 && float64(len(removed))*100 > g.MaxRemovedPercent*float64(len(current))))
+	if !tooMany {
+		g.refused = nil
+		g.removed = nil
+		g.blocked().Set(0)
+		return nil
+	}
+	sort.Strings(removed)
+	// only alert once while refreshes keep being refused
+	alert := g.refused == nil
+	g.refused = next
+	g.refusedAt = time.Now()
+	g.removed = removed
+	g.blocked().Set(1)
+	g.refusals().Inc()
+	event := SyncRefusedEvent{
+		Event:    syncRefusedEvent,
+		Time:     g.refusedAt.UTC(),
+		Tenant:   g.Tenant,
+		Users:    len(current),
+		Proposed: len(next),
+		Removed:  len(removed),
+		Sample:   removed,
+	}
+	if len(event.Sample) > syncRefusedSample {
+		event.Sample = event.Sample[:syncRefusedSample]
+	}
+	if alert {
+		keyChanges.notify(event)
+	}
+	return fmt.Errorf("Refusing users refresh%s that removes %d of %d users, keeping the previous users", tenantLabel(g.Tenant), len(removed), len(current))
+}
+
+// blocked, refusals and overrides return the metrics of the guard, tenants
+// have their own
+func (g *SyncGuard) blocked() prometheus.Gauge {
+	if g.Tenant != "" {
+		return metricTenantSyncGuardBlocked.WithLabelValues(g.Tenant)
+	}
+	return metricSyncGuardBlocked
+}
+
+func (g *SyncGuard) refusals() prometheus.Counter {
+	if g.Tenant != "" {
+		return metricTenantSyncGuardRefusalsTotal.WithLabelValues(g.Tenant)
+	}
+	return metricSyncGuardRefusalsTotal
+}
+
+func (g *SyncGuard) overrides() prometheus.Counter {
+	if g.Tenant != "" {
+		return metricTenantSyncGuardOverridesTotal.WithLabelValues(g.Tenant)
+	}
+	return metricSyncGuardOverridesTotal
+}
+
+// syncGuardPath returns the path of the sync guard routes of tenant
+func syncGuardPath(tenant string) string {
+	if tenant == "" {
+		return "/sync_guard"
+	}
+	return "/t/" + tenant + "/sync_guard"
+}
+
+// Register adds the routes to inspect and accept refused refreshes to
+// router behind the admin middleware
+func (g *SyncGuard) Register(router *mux.Router, admin mux.MiddlewareFunc) {
+	path := syncGuardPath(g.Tenant)
+	router.Handle(path, admin(http.HandlerFunc(g.getStatus))).Methods("GET")
+	router.Handle(path+"/accept", admin(http.HandlerFunc(g.accept))).Methods("POST")
+}
+
+func (g *SyncGuard) getStatus(w http.ResponseWriter, r *http.Request) {
+	refreshMutex.RLock()
+	status := syncGuardStatus{Users: len(tenantUsers(g.Tenant))}
+	refreshMutex.RUnlock()
+	g.mutex.Lock()
+	if g.refused != nil {
+		refusedAt := g.refusedAt
+		status.Blocked = true
+		status.RefusedAt = &refusedAt
+		status.Proposed = len(g.refused)
+		status.Removed = g.removed
+	}
+	g.mutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(status)
+}
+
+// accept replaces the users with the refused refresh
+func (g *SyncGuard) accept(w http.ResponseWriter, r *http.Request) {
+	g.mutex.Lock()
+	refused, removed := g.refused, len(g.removed)
+	g.refused = nil
+	g.removed = nil
+	g.mutex.Unlock()
+	w.Header().Set("Content-Type", "text/plain")
+	if refused == nil {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("409 no refused refresh\n"))
+		return
+	}
+	log.Warningf("Token %s accepted the refused users refresh%s removing %d users", tokenName(r), tenantLabel(g.Tenant), removed)
+	g.blocked().Set(0)
+	g.overrides().Inc()
+	setUsers(g.Tenant, refused)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf("Accepted refresh removing %d users\n", removed)))
+}
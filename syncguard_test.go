@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/patrickmn/go-cache"
+)
+
+// testUsers returns count users named user0, user1, ...
+func testUsers(count int) map[string]User {
+	result := make(map[string]User)
+	for i := 0; i < count; i++ {
+		result[fmt.Sprintf("user%d", i)] = newUser(fmt.Sprintf("user%d-gh", i))
+	}
+	return result
+}
+
+func TestSyncGuardLimits(t *testing.T) {
+	tests := []struct {
+		guard   *SyncGuard
+		current int
+		next    int
+		refused bool
+	}{
+		// offboarding in a small team stays below the floor
+		{&SyncGuard{MaxRemovedPercent: 50, MinRemovedUsers: 5}, 4, 1, false},
+		{&SyncGuard{MaxRemovedPercent: 50, MinRemovedUsers: 5}, 8, 2, true},
+		{&SyncGuard{MaxRemovedPercent: 50, MinRemovedUsers: 5}, 100, 60, false},
+		{&SyncGuard{MaxRemovedPercent: 50}, 2, 0, true},
+		{&SyncGuard{MaxRemovedUsers: 10, MinRemovedUsers: 5}, 100, 89, true},
+		{&SyncGuard{MaxRemovedUsers: 10, MinRemovedUsers: 5}, 100, 90, false},
+	}
+	for _, test := range tests {
+		err := test.guard.check(testUsers(test.current), testUsers(test.next))
+		if refused := err != nil; refused != test.refused {
+			t.Errorf("%+v removing %d of %d users: refused %v, want %v", test.guard, test.current-test.next, test.current, refused, test.refused)
+		}
+	}
+}
+
+func TestSyncGuardAccept(t *testing.T) {
+	pubkeyCache = cache.New(time.Minute, time.Minute)
+	idp = &staticProvider{users: testUsers(2)}
+	users = testUsers(20)
+	guard := &SyncGuard{MaxRemovedPercent: 50, MinRemovedUsers: 5}
+	if err := refreshTenantUsers("", idp, guard); err == nil || len(users) != 20 {
+		t.Fatalf("expected the refresh to be refused, got %v with %d users", err, len(users))
+	}
+
+	// without a tokens file the -auth token that may refresh accepts
+	authenticator, err := NewAuthenticator("", legacyTokens("admin", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	guard.Register(router, authenticator.requireAdmin())
+	accept := func(token string) int {
+		req := httptest.NewRequest("POST", "/sync_guard/accept", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := accept("other"); code != http.StatusUnauthorized || len(users) != 20 {
+		t.Errorf("accept without the admin token returned %d with %d users", code, len(users))
+	}
+	if code := accept("admin"); code != http.StatusOK || len(users) != 2 {
+		t.Errorf("accept returned %d with %d users", code, len(users))
+	}
+	if code := accept("admin"); code != http.StatusConflict {
+		t.Errorf("second accept returned %d", code)
+	}
+}
+
+func TestSyncGuardAcceptAdmin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pubkeyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens.json")
+	tokens := `{
+		"fleet": {"token": "fleet-token", "scopes": ["read", "refresh"]},
+		"ops": {"token": "ops-token", "scopes": ["admin"]}
+	}`
+	if err := ioutil.WriteFile(path, []byte(tokens), 0600); err != nil {
+		t.Fatal(err)
+	}
+	withFile, err := NewAuthenticator(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshOnly, err := NewAuthenticator("", legacyTokens("", "refresh-token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	none, err := NewAuthenticator("", legacyTokens("", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name          string
+		authenticator *Authenticator
+		token         string
+		status        int
+	}{
+		{"admin token", withFile, "ops-token", http.StatusConflict},
+		{"refresh token with tokens file", withFile, "fleet-token", http.StatusForbidden},
+		{"no token with tokens file", withFile, "", http.StatusUnauthorized},
+		{"-refresh-auth", refreshOnly, "refresh-token", http.StatusConflict},
+		{"no token with -refresh-auth", refreshOnly, "", http.StatusUnauthorized},
+		{"no tokens at all", none, "", http.StatusForbidden},
+		{"any token without tokens", none, "ops-token", http.StatusForbidden},
+	} {
+		router := mux.NewRouter()
+		(&SyncGuard{MaxRemovedPercent: 50}).Register(router, test.authenticator.requireAdmin())
+		req := httptest.NewRequest("POST", "/sync_guard/accept", nil)
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		// 409 as there is no refused refresh to accept
+		if w.Code != test.status {
+			t.Errorf("%s: got %d, want %d", test.name, w.Code, test.status)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/op/go-logging"
+	"github.com/oswell/onelogin-go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// separates the tenant from the username in the keys of users, usernames
+// containing it are dropped so that no user of the main identity provider
+// can be mistaken for one of a tenant
+const tenantSeparator = "\x00"
+
+var (
+	// tenants by name, nil without -tenants-file
+	tenants map[string]*Tenant
+
+	// the metrics of the main identity provider stay as they are, tenants
+	// have their own
+	metricTenantKnownUsers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pubkeyd_tenant_known_users",
+		Help: "Number of currently known users of a tenant.",
+	}, []string{"tenant"},
+	)
+	metricTenantRefreshesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubkeyd_tenant_refreshes_total",
+		Help: "Number of users refreshes of a tenant.",
+	}, []string{"tenant"},
+	)
+	metricTenantAuthorizedKeysRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubkeyd_tenant_authorized_keys_requests_total",
+		Help: "Number of authorized_keys requests for users of a tenant, partitioned by tenant, status code and HTTP method.",
+	}, []string{"tenant", "code", "method"},
+	)
+	metricTenantGithubNameRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubkeyd_tenant_github_name_requests_total",
+		Help: "Number of github_name requests for users of a tenant, partitioned by tenant, status code and HTTP method.",
+	}, []string{"tenant", "code", "method"},
+	)
+	metricTenantOneLoginSyncsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubkeyd_tenant_onelogin_syncs_total",
+		Help: "Number of successful OneLogin user syncs of a tenant, partitioned by tenant and type: full or incremental.",
+	}, []string{"tenant", "type"},
+	)
+	metricTenantOneLoginSyncDelta = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pubkeyd_tenant_onelogin_sync_delta_users",
+		Help: "Number of users the last OneLogin sync of a tenant and type added, changed or removed.",
+	}, []string{"tenant", "type", "change"},
+	)
+	metricTenantOneLoginSyncChangesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubkeyd_tenant_onelogin_sync_changes_total",
+		Help: "Number of users OneLogin syncs of a tenant added, changed or removed, partitioned by tenant, sync type and change.",
+	}, []string{"tenant", "type", "change"},
+	)
+	metricTenantOneLoginEventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubkeyd_tenant_onelogin_events_total",
+		Help: "Number of users of a tenant changed by OneLogin events, partitioned by tenant and action: set or delete.",
+	}, []string{"tenant", "action"},
+	)
+	metricTenantOneLoginEventPollFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubkeyd_tenant_onelogin_event_poll_failures_total",
+		Help: "Number of failed polls of the OneLogin events API of a tenant.",
+	}, []string{"tenant"},
+	)
+	metricTenantSyncGuardBlocked = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pubkeyd_tenant_sync_guard_blocked",
+		Help: "Whether the last users refresh of a tenant was refused because it removed too many users.",
+	}, []string{"tenant"},
+	)
+	metricTenantSyncGuardRefusalsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubkeyd_tenant_sync_guard_refusals_total",
+		Help: "Number of users refreshes of a tenant refused because they removed too many users.",
+	}, []string{"tenant"},
+	)
+	metricTenantSyncGuardOverridesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubkeyd_tenant_sync_guard_overrides_total",
+		Help: "Number of refused users refreshes of a tenant accepted by an admin.",
+	}, []string{"tenant"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricTenantKnownUsers)
+	prometheus.MustRegister(metricTenantRefreshesTotal)
+	prometheus.MustRegister(metricTenantAuthorizedKeysRequestsTotal)
+	prometheus.MustRegister(metricTenantGithubNameRequestsTotal)
+	prometheus.MustRegister(metricTenantOneLoginSyncsTotal)
+	prometheus.MustRegister(metricTenantOneLoginSyncDelta)
+	prometheus.MustRegister(metricTenantOneLoginSyncChangesTotal)
+	prometheus.MustRegister(metricTenantOneLoginEventsTotal)
+	prometheus.MustRegister(metricTenantOneLoginEventPollFailuresTotal)
+	prometheus.MustRegister(metricTenantSyncGuardBlocked)
+	prometheus.MustRegister(metricTenantSyncGuardRefusalsTotal)
+	prometheus.MustRegister(metricTenantSyncGuardOverridesTotal)
+}
+
+// Tenant is a further OneLogin account whose users are served next to the
+// users of the main identity provider. They are read from a JSON file:
+//
+//	{
+//	  "sub": {
+//	    "shard": "eu", "client_id": "...", "client_secret": "...", "subdomain": "subsidiary",
+//	    "github_attr": "github", "suffix": ".sub"
+//	  }
+//	}
+//
+// The users of a tenant are kept in users qualified by tenantSeparator with
+// their roles qualified as tenant/role, so that host groups only apply to
+// them if they name those roles.
+type Tenant struct {
+	Name         string `json:"-"`
+	Shard        string `json:"shard"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	Subdomain    string `json:"subdomain"`
+	// custom attributes holding the github name and keys, see -keys-attr
+	GithubAttr    string `json:"github_attr,omitempty"`
+	KeysAttr      string `json:"keys_attr,omitempty"`
+	KeysAttrMerge *bool  `json:"keys_attr_merge,omitempty"`
+	// usernames ending in Suffix are looked up without it in the tenant
+	Suffix string `json:"suffix,omitempty"`
+	// intervals in seconds, see -refresh, -onelogin-full-refresh and
+	// -onelogin-events
+	Refresh      int    `json:"refresh,omitempty"`
+	FullRefresh  int    `json:"full_refresh,omitempty"`
+	Events       int    `json:"events,omitempty"`
+	EventsCursor string `json:"events_cursor,omitempty"`
+
+	provider *OneLoginProvider
+	guard    *SyncGuard
+	// requests a refresh in between, see requestRefresh
+	refresh chan bool
+}
+
+// loadTenants reads the tenants from path
+func loadTenants(path string) (map[string]*Tenant, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %v", path, err)
+	}
+	var tenants map[string]*Tenant
+	if err := json.Unmarshal(data, &tenants); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %v", path, err)
+	}
+	for name, tenant := range tenants {
+		if !accountNameRegex.MatchString(name) {
+			return nil, fmt.Errorf("Invalid tenant name %s in %s", name, path)
+		}
+		if tenant.ClientID == "" || tenant.ClientSecret == "" {
+			return nil, fmt.Errorf("Tenant %s in %s needs client_id and client_secret", name, path)
+		}
+		tenant.Name = name
+		if tenant.Shard == "" {
+			tenant.Shard = "us"
+		}
+	}
+	log.Infof("Loaded %d tenants", len(tenants))
+	return tenants, nil
+}
+
+// tenantQualified returns the key in users of a user of tenant, tenant is
+// empty for the main identity provider
+func tenantQualified(tenant string, user string) string {
+	if tenant == "" {
+		return user
+	}
+	return tenant + tenantSeparator + user
+}
+
+// splitUser returns the tenant and username of a key in users
+func splitUser(key string) (string, string) {
+	if i := strings.Index(key, tenantSeparator); i != -1 {
+		return key[:i], key[i+len(tenantSeparator):]
+	}
+	return "", key
+}
+
+// userTenant returns the tenant of a key in users
+func userTenant(key string) string {
+	tenant, _ := splitUser(key)
+	return tenant
+}
+
+// displayUser returns a key in users as tenant/username for log messages
+func displayUser(key string) string {
+	if tenant, user := splitUser(key); tenant != "" {
+		return tenant + "/" + user
+	}
+	return key
+}
+
+// validUsername reports whether a username of an identity provider can be
+// kept in users
+func validUsername(user string) bool {
+	return !strings.Contains(user, tenantSeparator)
+}
+
+// tenantRole returns the name of a role of tenant as matched by host groups
+func tenantRole(tenant string, role string) string {
+	if tenant == "" {
+		return role
+	}
+	return tenant + "/" + role
+}
+
+// tenantUsers returns the users of tenant by username, it must be called
+// with refreshMutex held
+func tenantUsers(tenant string) map[string]User {
+	result := make(map[string]User)
+	for key, u := range users {
+		if userTenant, user := splitUser(key); userTenant == tenant {
+			result[user] = u
+		}
+	}
+	return result
+}
+
+// tenantLabel names tenant in log messages
+func tenantLabel(tenant string) string {
+	if tenant == "" {
+		return ""
+	}
+	return " of tenant " + tenant
+}
+
+// requestedUser returns the key in users of the user a request is for and
+// its tenant. The tenant is taken from the /t/{tenant} path prefix or the
+// longest matching username suffix of a tenant. It fails for unknown
+// tenants and usernames no identity provider can return.
+func requestedUser(r *http.Request) (string, string, error) {
+	params := mux.Vars(r)
+	user := params["id"]
+	if !validUsername(user) {
+		return "", "", fmt.Errorf("Invalid username %q", user)
+	}
+	if tenant, ok := params["tenant"]; ok {
+		if _, known := tenants[tenant]; !known {
+			return "", "", fmt.Errorf("Tenant %s not found", tenant)
+		}
+		return tenantQualified(tenant, user), tenant, nil
+	}
+	match := ""
+	for name, tenant := range tenants {
+		if tenant.Suffix != "" && len(user) > len(tenant.Suffix) && strings.HasSuffix(user, tenant.Suffix) &&
+			(match == "" || len(tenant.Suffix) > len(tenants[match].Suffix)) {
+			match = name
+		}
+	}
+	if match == "" {
+		return user, "", nil
+	}
+	return tenantQualified(match, strings.TrimSuffix(user, tenants[match].Suffix)), match, nil
+}
+
+// requestRefresh makes the refresh loop of the tenant refresh its users
+// right away unless a refresh is pending already
+func (t *Tenant) requestRefresh() {
+	select {
+	case t.refresh <- true:
+	default:
+	}
+}
+
+// refreshTenants requests a refresh of the users of all tenants
+func refreshTenants() {
+	for _, tenant := range tenants {
+		tenant.requestRefresh()
+	}
+}
+
+// start creates the OneLogin provider of the tenant and refreshes its
+// users every refresh unless the tenant has its own interval
+func (t *Tenant) start(loglevel logging.Level, refresh time.Duration, guard *SyncGuard, eventTypes []string) error {
+	keysMerge := true
+	if t.KeysAttrMerge != nil {
+		keysMerge = *t.KeysAttrMerge
+	}
+	t.provider = &OneLoginProvider{
+		OneLogin:    onelogin.New(t.Shard, t.ClientID, t.ClientSecret, t.Subdomain, loglevel),
+		Keys:        KeysAttribute{Name: t.KeysAttr, Merge: keysMerge},
+		FullRefresh: time.Duration(t.FullRefresh) * time.Second,
+		GithubAttr:  t.GithubAttr,
+		Tenant:      t.Name,
+	}
+	if guard != nil {
+		t.guard = &SyncGuard{
+			MaxRemovedPercent: guard.MaxRemovedPercent,
+			MaxRemovedUsers:   guard.MaxRemovedUsers,
+			MinRemovedUsers:   guard.MinRemovedUsers,
+			Tenant:            t.Name,
+		}
+	}
+	if t.Refresh > 0 {
+		refresh = time.Duration(t.Refresh) * time.Second
+	}
+	if t.Events > 0 {
+		eventSync, err := NewOneLoginEventSync(t.provider, t.EventsCursor, eventTypes)
+		if err != nil {
+			return err
+		}
+		go eventSync.run(time.Duration(t.Events) * time.Second)
+	}
+	t.refresh = make(chan bool, 1)
+	go t.run(refresh)
+	return nil
+}
+
+// run refreshes the users of the tenant every refresh and when requested
+func (t *Tenant) run(refresh time.Duration) {
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+	for {
+		if err := refreshTenantUsers(t.Name, t.provider, t.guard); err != nil {
+			log.Errorf("Failed to refresh users of tenant %s: %v", t.Name, err)
+		}
+		select {
+		case <-ticker.C:
+		case <-t.refresh:
+		}
+	}
+}
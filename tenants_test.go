@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gaugeValue returns the current value of g
+func gaugeValue(t *testing.T, g prometheus.Gauge) float64 {
+	var m dto.Metric
+	if err := g.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func TestRequestedUser(t *testing.T) {
+	defer func() { tenants = nil }()
+	tenants = map[string]*Tenant{
+		"sub":   {Name: "sub", Suffix: ".sub"},
+		"eu":    {Name: "eu", Suffix: ".eu.sub"},
+		"plain": {Name: "plain"},
+	}
+	for _, test := range []struct {
+		vars   map[string]string
+		user   string
+		tenant string
+		err    bool
+	}{
+		{map[string]string{"id": "alice"}, "alice", "", false},
+		{map[string]string{"id": "alice.sub"}, tenantQualified("sub", "alice"), "sub", false},
+		// the longest suffix wins
+		{map[string]string{"id": "alice.eu.sub"}, tenantQualified("eu", "alice"), "eu", false},
+		// a suffix alone is no user of the tenant
+		{map[string]string{"id": ".sub"}, ".sub", "", false},
+		// the path prefix takes precedence over suffixes
+		{map[string]string{"tenant": "plain", "id": "alice.sub"}, tenantQualified("plain", "alice.sub"), "plain", false},
+		{map[string]string{"tenant": "other", "id": "alice"}, "", "", true},
+		{map[string]string{"id": "sub\x00alice"}, "", "", true},
+		{map[string]string{"tenant": "sub", "id": "eu\x00alice"}, "", "", true},
+	} {
+		r := mux.SetURLVars(httptest.NewRequest("GET", "/", nil), test.vars)
+		user, tenant, err := requestedUser(r)
+		if user != test.user || tenant != test.tenant || (err != nil) != test.err {
+			t.Errorf("%v: got %q, %q, %v, want %q, %q", test.vars, user, tenant, err, test.user, test.tenant)
+		}
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	source := &fakeKeySource{keys: map[string]string{
+		"main-alice":  testGithubKey + "\n",
+		"slash-alice": testGithubKey + "\n",
+		"sub-alice":   testOtherKey + "\n",
+	}}
+	keySources["fake"] = source
+	defer delete(keySources, "fake")
+	pubkeyCache = cache.New(time.Minute, time.Minute)
+	fingerprintIndex = NewFingerprintIndex()
+	defer func() { tenants = nil }()
+	tenants = map[string]*Tenant{"sub": {Name: "sub", Suffix: ".sub"}}
+	users = nil
+
+	// a username of the main identity provider that looks like one of a
+	// tenant stays with the main identity provider
+	setUsers("", map[string]User{
+		"alice":      {Accounts: map[string]string{"fake": "main-alice"}},
+		"sub/alice":  {Accounts: map[string]string{"fake": "slash-alice"}},
+		"sub\x00bob": {Accounts: map[string]string{"fake": "main-alice"}},
+	})
+	setUsers("sub", map[string]User{
+		"alice": {Accounts: map[string]string{"fake": "sub-alice"}, Roles: []string{tenantRole("sub", "ops")}},
+	})
+	if len(users) != 3 || len(tenantUsers("")) != 2 || len(tenantUsers("sub")) != 1 {
+		t.Fatalf("got users %q", users)
+	}
+	if known, tenantKnown := gaugeValue(t, metricKnownUsers), gaugeValue(t, metricTenantKnownUsers.WithLabelValues("sub")); known != 2 || tenantKnown != 1 {
+		t.Errorf("got %v known users and %v of the tenant", known, tenantKnown)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/authorized_keys/{id}", getAuthorizedKeys).Methods("GET")
+	router.HandleFunc("/t/{tenant}/authorized_keys/{id}", getAuthorizedKeys).Methods("GET")
+	mainRequests := metricAuthorizedKeysRequestsTotal.WithLabelValues("200", "GET")
+	tenantRequests := metricTenantAuthorizedKeysRequestsTotal.WithLabelValues("sub", "200", "GET")
+	mainBefore, tenantBefore := counterValue(t, mainRequests), counterValue(t, tenantRequests)
+	for _, test := range []struct {
+		path   string
+		status int
+		keys   string
+	}{
+		{"/authorized_keys/alice", http.StatusOK, testGithubKey + "\n"},
+		{"/authorized_keys/alice.sub", http.StatusOK, testOtherKey + "\n"},
+		{"/t/sub/authorized_keys/alice", http.StatusOK, testOtherKey + "\n"},
+		{"/t/other/authorized_keys/alice", http.StatusNotFound, ""},
+		{"/t/sub/authorized_keys/bob", http.StatusNotFound, ""},
+		{"/authorized_keys/sub%00alice", http.StatusNotFound, ""},
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Code != test.status || (test.keys != "" && w.Body.String() != test.keys) {
+			t.Errorf("%s: got %d %q, want %d %q", test.path, w.Code, w.Body, test.status, test.keys)
+		}
+	}
+	if main, tenant := counterValue(t, mainRequests)-mainBefore, counterValue(t, tenantRequests)-tenantBefore; main != 1 || tenant != 2 {
+		t.Errorf("counted %v requests of the main identity provider and %v of the tenant, want 1 and 2", main, tenant)
+	}
+	if entries := fingerprintIndex.lookup(sha256Fingerprint(t, testOtherKey)); len(entries) != 1 || entries[0].Tenant != "sub" || entries[0].User != "alice" {
+		t.Errorf("got fingerprint entries %+v of the tenant user", entries)
+	}
+
+	// principals and shared accounts stay with the main identity provider
+	all := func(User) bool { return true }
+	if principals := (PrincipalRules{"root": {"sub/ops"}}).principals("root", users, all); len(principals) != 0 {
+		t.Errorf("got principals %q of tenant users", principals)
+	}
+	if members := (SharedAccounts{"deploy": {"sub/ops"}}).members("deploy", users, all); len(members) != 0 {
+		t.Errorf("got shared account members %v of tenant users", members)
+	}
+
+	// refreshes only replace the users of their own tenant
+	setUsers("", map[string]User{"alice": users["alice"]})
+	if _, ok := users["sub/alice"]; ok || len(tenantUsers("sub")) != 1 {
+		t.Errorf("got users %q after the main identity provider removed sub/alice", users)
+	}
+	setUsers("sub", map[string]User{})
+	if _, ok := users["alice"]; !ok || len(users) != 1 {
+		t.Errorf("got users %q after the tenant removed its users", users)
+	}
+	if tenantKnown := gaugeValue(t, metricTenantKnownUsers.WithLabelValues("sub")); tenantKnown != 0 {
+		t.Errorf("got %v known users of the tenant without users", tenantKnown)
+	}
+}
+
+func TestTenantRefresh(t *testing.T) {
+	defer func() { tenants = nil }()
+	tenants = map[string]*Tenant{
+		"sub": {Name: "sub", refresh: make(chan bool, 1)},
+		"eu":  {Name: "eu", refresh: make(chan bool, 1)},
+	}
+	manualRefresh = make(chan bool, 1)
+	defer func() { manualRefresh = nil }()
+
+	w := httptest.NewRecorder()
+	doRefresh(w, httptest.NewRequest("GET", "/refresh", nil))
+	if w.Code != http.StatusOK || len(manualRefresh) != 1 {
+		t.Errorf("got %d, %d pending refreshes of the main identity provider", w.Code, len(manualRefresh))
+	}
+	for name, tenant := range tenants {
+		if len(tenant.refresh) != 1 {
+			t.Errorf("no refresh of tenant %s requested", name)
+		}
+		// requests while a refresh is pending don't block
+		tenant.requestRefresh()
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TLSReloader serves TLS with a certificate and key, and optionally client
+// CAs, that are reloaded when their files change
+type TLSReloader struct {
+	CertFile string
+	KeyFile  string
+	// PEM file of CAs that issue client certificates, empty to not ask for them
+	ClientCAFile      string
+	RequireClientCert bool
+
+	mutex  sync.RWMutex
+	config *tls.Config
+}
+
+// NewTLSReloader loads the certificate, key and client CAs
+func NewTLSReloader(certFile, keyFile, clientCAFile string, requireClientCert bool) (*TLSReloader, error) {
+	if requireClientCert && clientCAFile == "" {
+		return nil, fmt.Errorf("Client certificates can't be required without client CAs to verify them")
+	}
+	t := &TLSReloader{
+		CertFile:          certFile,
+		KeyFile:           keyFile,
+		ClientCAFile:      clientCAFile,
+		RequireClientCert: requireClientCert,
+	}
+	return t, t.load()
+}
+
+func (t *TLSReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return fmt.Errorf("Failed to load TLS certificate: %v", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if t.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(t.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("Failed to read client CAs: %v", err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No certificates found in %s", t.ClientCAFile)
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if t.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	t.mutex.Lock()
+	t.config = config
+	t.mutex.Unlock()
+	log.Infof("Loaded TLS certificate %s", t.CertFile)
+	return nil
+}
+
+// Watch reloads the certificate, key and client CAs whenever one of their
+// files changes
+func (t *TLSReloader) Watch(interval time.Duration) {
+	for _, path := range []string{t.CertFile, t.KeyFile, t.ClientCAFile} {
+		if path == "" {
+			continue
+		}
+		go watchPath(path, interval, func() {
+			if err := t.load(); err != nil {
+				log.Errorf("Keeping previous TLS certificate: %v", err)
+			}
+		})
+	}
+}
+
+// TLSConfig returns a config that always uses the last loaded certificate
+func (t *TLSReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			t.mutex.RLock()
+			defer t.mutex.RUnlock()
+			return t.config, nil
+		},
+		// older Go versions only accept a config without certificates if it
+		// has GetCertificate
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			t.mutex.RLock()
+			defer t.mutex.RUnlock()
+			return &t.config.Certificates[0], nil
+		},
+	}
+}
+
+// clientNames returns the common name and DNS names of the verified client
+// certificate of r, if any
+func clientNames(r *http.Request) []string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	var names []string
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	return append(names, cert.DNSNames...)
+}
+
+// clientHost identifies the host that sent r by its client certificate,
+// falling back to its address
+func clientHost(r *http.Request) string {
+	if names := clientNames(r); len(names) > 0 {
+		return names[0]
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate with its key, signed by parent or self-signed
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, parent *testCert, template *x509.Certificate) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer := &testCert{template, key}
+	if parent != nil {
+		signer = parent
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer.cert, &key.PublicKey, signer.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert, key}
+}
+
+// write writes the certificate and key as PEM files to dir and returns
+// their paths
+func (c *testCert) write(t *testing.T, dir string, name string) (string, string) {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func TestTLSReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pubkeyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "test CA"}, IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign})
+	caFile, _ := ca.write(t, dir, "ca")
+	serverTemplate := func() *x509.Certificate {
+		return &x509.Certificate{Subject: pkix.Name{CommonName: "pubkey.example.com"}, DNSNames: []string{"localhost"}, IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+	}
+	server := newTestCert(t, ca, serverTemplate())
+	certFile, keyFile := server.write(t, dir, "server")
+	client := newTestCert(t, ca, &x509.Certificate{Subject: pkix.Name{CommonName: "web1.prod.example.com"}, DNSNames: []string{"web1"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+
+	if _, err := NewTLSReloader(certFile, keyFile, "", true); err == nil {
+		t.Error("required client certificates without client CAs")
+	}
+	reloader, err := NewTLSReloader(certFile, keyFile, caFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", reloader.TLSConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(clientHost(r)))
+	}))
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	// get returns the client host the server saw and the certificate it served
+	get := func(certificates ...tls.Certificate) (string, *x509.Certificate, error) {
+		transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certificates}}
+		defer transport.CloseIdleConnections()
+		resp, err := (&http.Client{Transport: transport}).Get("https://" + listener.Addr().String() + "/")
+		if err != nil {
+			return "", nil, err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), resp.TLS.PeerCertificates[0], err
+	}
+
+	host, served, err := get(client.tlsCertificate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "web1.prod.example.com" || served.SerialNumber.Cmp(server.cert.SerialNumber) != 0 {
+		t.Errorf("got client host %q and server certificate %s", host, served.SerialNumber)
+	}
+	if _, _, err := get(); err == nil {
+		t.Error("accepted a client without a certificate")
+	}
+	stranger := newTestCert(t, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "web1.prod.example.com"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	if _, _, err := get(stranger.tlsCertificate()); err == nil {
+		t.Error("accepted a client certificate of another CA")
+	}
+
+	// a renewed certificate is served after the reload, a broken one is not
+	renewed := newTestCert(t, ca, serverTemplate())
+	renewed.write(t, dir, "server")
+	if err := reloader.load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, served, err = get(client.tlsCertificate()); err != nil || served.SerialNumber.Cmp(renewed.cert.SerialNumber) != 0 {
+		t.Errorf("got certificate %v after the reload, %v", served, err)
+	}
+	if err := ioutil.WriteFile(keyFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloader.load(); err == nil {
+		t.Error("loaded a broken key")
+	}
+	if _, served, err = get(client.tlsCertificate()); err != nil || served.SerialNumber.Cmp(renewed.cert.SerialNumber) != 0 {
+		t.Errorf("got certificate %v after a failed reload, %v", served, err)
+	}
+
+	// without requiring them client certificates are optional
+	renewed.write(t, dir, "server")
+	reloader.RequireClientCert = false
+	if err := reloader.load(); err != nil {
+		t.Fatal(err)
+	}
+	if host, _, err := get(); err != nil || host == "web1.prod.example.com" {
+		t.Errorf("got client host %q without a client certificate, %v", host, err)
+	}
+}
+
+func TestClientNames(t *testing.T) {
+	r, err := http.NewRequest("GET", "/authorized_keys/alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RemoteAddr = "10.0.0.7:50000"
+	if names := clientNames(r); names != nil || clientHost(r) != r.RemoteAddr {
+		t.Errorf("got names %v and host %s without TLS", names, clientHost(r))
+	}
+	// unverified certificates don't count
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "web1"}}}}
+	if names := clientNames(r); names != nil {
+		t.Errorf("got names %v of an unverified certificate", names)
+	}
+	r.TLS = verifiedClientCert("web1.prod.example.com", "web1", "web1.example.com")
+	if names := clientNames(r); len(names) != 3 || names[0] != "web1.prod.example.com" || names[2] != "web1.example.com" || clientHost(r) != names[0] {
+		t.Errorf("got names %v and host %s", names, clientHost(r))
+	}
+	r.TLS = verifiedClientCert("", "web1.example.com")
+	if names := clientNames(r); len(names) != 1 || clientHost(r) != "web1.example.com" {
+		t.Errorf("got names %v and host %s without a common name", names, clientHost(r))
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v2"
+)
+
+// FileProvider reads users from a JSON or YAML file or from all *.json,
+// *.yaml and *.yml files in a directory, YAML files are recognized by their
+// extension. A user maps to a github name, to accounts on other key
+// sources, to inline authorized_keys entries or to several of those:
+//
+//	{
+//	  "users": {
+//	    "alice": "alice-on-github",
+//	    "bob": "gitlab:bob",
+//	    "deploy": {"github": "acme-deploy-bot", "accounts": {"gitea": "deploy"}},
+//	    "breakglass": {"keys": ["ssh-ed25519 AAAAC3Nz... breakglass"]}
+//	  }
+//	}
+type FileProvider struct {
+	Path string
+}
+
+type userFile struct {
+	Users map[string]json.RawMessage `json:"users"`
+}
+
+// Users returns the users of all files, later files override earlier ones
+func (p *FileProvider) Users() (map[string]User, error) {
+	log.Infof("Updating users from %s", p.Path)
+	fileUsers := make(map[string]User)
+	files, err := p.files()
+	if err != nil {
+		return fileUsers, fmt.Errorf("Failed to get users: %v", err)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fileUsers, fmt.Errorf("Failed to read %s: %v", file, err)
+		}
+		if isYAMLFile(file) {
+			if data, err = yamlToJSON(data); err != nil {
+				return fileUsers, fmt.Errorf("Failed to parse %s: %v", file, err)
+			}
+		}
+		var f userFile
+		if err := json.Unmarshal(data, &f); err != nil {
+			return fileUsers, fmt.Errorf("Failed to parse %s: %v", file, err)
+		}
+		for username, raw := range f.Users {
+			user, err := parseFileUser(raw)
+			if err != nil {
+				return fileUsers, fmt.Errorf("Invalid user %s in %s: %v", username, file, err)
+			}
+			log.Debugf("Adding user %s from %s", username, file)
+			fileUsers[username] = user
+		}
+	}
+	return fileUsers, nil
+}
+
+func parseFileUser(raw json.RawMessage) (User, error) {
+	var user User
+	var githubName string
+	if err := json.Unmarshal(raw, &githubName); err == nil {
+		user = newUser(githubName)
+	} else if err := json.Unmarshal(raw, &user); err != nil {
+		return user, err
+	}
+	for _, key := range user.Keys {
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key)); err != nil {
+			return user, fmt.Errorf("invalid key %q: %v", key, err)
+		}
+	}
+	if user.empty() {
+		return user, fmt.Errorf("neither github name, accounts nor keys set")
+	}
+	return user, nil
+}
+
+func (p *FileProvider) files() ([]string, error) {
+	info, err := os.Stat(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{p.Path}, nil
+	}
+	var files []string
+	for _, pattern := range []string{"*.json", "*.yaml", "*.yml"} {
+		matches, err := filepath.Glob(filepath.Join(p.Path, pattern))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func isYAMLFile(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// yamlToJSON converts a YAML document to JSON so that it is parsed like a
+// JSON users file
+func yamlToJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	v, err := jsonValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// jsonValue converts the maps with interface{} keys of the YAML decoder to
+// maps with string keys
+func jsonValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			name, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("non-string key %v", key)
+			}
+			converted, err := jsonValue(value)
+			if err != nil {
+				return nil, err
+			}
+			m[name] = converted
+		}
+		return m, nil
+	case []interface{}:
+		for i, value := range v {
+			converted, err := jsonValue(value)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = converted
+		}
+		return v, nil
+	}
+	return v, nil
+}
+
+// Watch calls changed whenever the users file or directory changes
+func (p *FileProvider) Watch(interval time.Duration, changed func()) {
+	watchPath(p.Path, interval, changed)
+}
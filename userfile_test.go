@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFileProviderJSONAndYAML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pubkeyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"a.json": `{"users": {"alice": "alice-gh", "bob": "bob-gh"}}`,
+		"b.yaml": `
+users:
+  bob: gitlab:bob
+  deploy:
+    github: acme-deploy-bot
+    accounts:
+      gitea: deploy
+`,
+		"c.yml": `
+users:
+  breakglass:
+    keys:
+      - ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl breakglass
+`,
+		"ignored.txt": `users: {eve: eve}`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := (&FileProvider{Path: dir}).Users()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]User{
+		"alice":      newUser("alice-gh"),
+		"bob":        newUser("gitlab:bob"),
+		"deploy":     {GithubName: "acme-deploy-bot", Accounts: map[string]string{"gitea": "deploy"}},
+		"breakglass": {Keys: []string{"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl breakglass"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got users %v, want %v", got, want)
+	}
+}
+
+func TestFileProviderInvalidYAML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pubkeyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.yaml")
+	if err := ioutil.WriteFile(path, []byte("users:\n  alice: [unterminated\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&FileProvider{Path: path}).Users(); err == nil {
+		t.Error("expected an error for invalid YAML")
+	}
+}
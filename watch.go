@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// pathVersion changes whenever the file at path, or a file in the
+// directory at path, is added, removed or modified
+func pathVersion(path string) string {
+	files := []string{path}
+	if info, err := os.Stat(path); err != nil {
+		return err.Error()
+	} else if info.IsDir() {
+		files, _ = filepath.Glob(filepath.Join(path, "*"))
+	}
+	version := ""
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			version += fmt.Sprintf("%s:%d:%d;", file, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return version
+}
+
+// watchPath polls path every interval and calls changed when it changed
+func watchPath(path string, interval time.Duration, changed func()) {
+	last := pathVersion(path)
+	for range time.Tick(interval) {
+		if current := pathVersion(path); current != last {
+			log.Infof("%s changed", path)
+			last = current
+			changed()
+		}
+	}
+}